@@ -2,24 +2,52 @@ CREATE TABLE user (
   id BIGINT UNSIGNED AUTO_INCREMENT NOT NULL PRIMARY KEY,
   name VARCHAR(191) UNIQUE,
   salt VARCHAR(20),
-  password VARCHAR(40),
+  password VARCHAR(255),
   display_name TEXT,
   avatar_icon TEXT,
+  is_admin TINYINT(1) NOT NULL DEFAULT 0,
   created_at DATETIME NOT NULL
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
 
+CREATE TABLE session (
+  id VARCHAR(64) NOT NULL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  user_agent TEXT,
+  ip_address VARCHAR(64),
+  created_at DATETIME NOT NULL,
+  last_seen_at DATETIME NOT NULL,
+  expires_at DATETIME NOT NULL,
+  INDEX (user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
 CREATE TABLE image (
   id BIGINT UNSIGNED AUTO_INCREMENT NOT NULL PRIMARY KEY,
   name VARCHAR(191),
-  data LONGBLOB
+  data LONGBLOB,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  INDEX (name)
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE channel (
   id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
   name TEXT NOT NULL,
   description MEDIUMTEXT,
+  is_private TINYINT(1) NOT NULL DEFAULT 0,
+  is_direct TINYINT(1) NOT NULL DEFAULT 0,
+  direct_key VARCHAR(191) NULL,
+  is_archived TINYINT(1) NOT NULL DEFAULT 0,
+  owner_id BIGINT NOT NULL DEFAULT 0,
   updated_at DATETIME NOT NULL,
-  created_at DATETIME NOT NULL
+  created_at DATETIME NOT NULL,
+  UNIQUE (direct_key)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE channel_member (
+  channel_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(channel_id, user_id),
+  INDEX (user_id)
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE message (
@@ -27,14 +55,77 @@ CREATE TABLE message (
   channel_id BIGINT,
   user_id BIGINT,
   content TEXT,
-  created_at DATETIME NOT NULL
+  created_at DATETIME NOT NULL,
+  edited_at DATETIME NULL,
+  deleted_at DATETIME NULL,
+  parent_id BIGINT NOT NULL DEFAULT 0,
+  reply_count INT NOT NULL DEFAULT 0,
+  last_reply_at DATETIME NULL,
+  INDEX (channel_id, parent_id, id),
+  INDEX (parent_id, id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE message_edit (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  message_id BIGINT NOT NULL,
+  content TEXT,
+  edited_at DATETIME NOT NULL,
+  INDEX (message_id)
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE haveread (
   user_id BIGINT NOT NULL,
   channel_id BIGINT NOT NULL,
   message_id BIGINT,
+  message_count BIGINT NOT NULL DEFAULT 0,
   updated_at DATETIME NOT NULL,
   created_at DATETIME NOT NULL,
   PRIMARY KEY(user_id, channel_id)
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE channel_counter (
+  channel_id BIGINT NOT NULL PRIMARY KEY,
+  message_count BIGINT NOT NULL DEFAULT 0
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE thread_haveread (
+  user_id BIGINT NOT NULL,
+  parent_id BIGINT NOT NULL,
+  message_id BIGINT,
+  reply_count BIGINT NOT NULL DEFAULT 0,
+  updated_at DATETIME NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(user_id, parent_id),
+  INDEX (parent_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE reaction (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  message_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  emoji VARCHAR(128) NOT NULL,
+  created_at DATETIME NOT NULL,
+  UNIQUE (message_id, user_id, emoji)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE reaction_log (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  channel_id BIGINT NOT NULL,
+  message_id BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  INDEX (channel_id, id),
+  INDEX (created_at)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE mention (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  message_id BIGINT NOT NULL,
+  channel_id BIGINT NOT NULL,
+  parent_id BIGINT NOT NULL DEFAULT 0,
+  user_id BIGINT NOT NULL,
+  is_unread TINYINT(1) NOT NULL DEFAULT 1,
+  created_at DATETIME NOT NULL,
+  INDEX (user_id),
+  INDEX (user_id, is_unread, channel_id, parent_id, message_id),
+  INDEX (message_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+)
+
+// JSON API under /api/v1.
+//
+// Every error is returned as
+//
+//	{"error": {"code": 404, "message": "Not Found"}}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func apiErrorResponse(c echo.Context, code int, message string) error {
+	return c.JSON(code, map[string]interface{}{"error": apiError{Code: code, Message: message}})
+}
+
+// apiErrorHandler renders errors returned by the API handlers as error objects.
+func apiErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if err == nil || c.Response().Committed {
+			return err
+		}
+
+		if he, ok := err.(*echo.HTTPError); ok {
+			return apiErrorResponse(c, he.Code, fmt.Sprint(he.Message))
+		}
+		logAt(levelError, "api error", logFields{"request_id": requestID(c), "error": err.Error()})
+		code := http.StatusInternalServerError
+		return apiErrorResponse(c, code, http.StatusText(code))
+	}
+}
+
+// apiAuth rejects requests without a valid session and stores the user as "user".
+func apiAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := sessUserID(c)
+		if userID == 0 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "login required")
+		}
+		user, err := getUser(c.Request().Context(), userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			sessClearUserID(c)
+			return echo.NewHTTPError(http.StatusUnauthorized, "login required")
+		}
+		c.Set("user", user)
+		return next(c)
+	}
+}
+
+func apiUser(c echo.Context) *User {
+	return c.Get("user").(*User)
+}
+
+// apiChannelParam returns the channel :channel_id if the user can see it.
+func apiChannelParam(c echo.Context) (*ChannelInfo, error) {
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || chID <= 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid channel_id")
+	}
+	if err := checkChannelAccess(c.Request().Context(), apiUser(c).ID, chID); err == echo.ErrNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "channel not found")
+	} else if err != nil {
+		return nil, err
+	}
+	ch, err := getChannelInfo(c.Request().Context(), chID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "channel not found")
+	}
+	return ch, nil
+}
+
+type apiCredentials struct {
+	Name     string `json:"name" form:"name"`
+	Password string `json:"password" form:"password"`
+}
+
+func apiPostUsers(c echo.Context) error {
+	var req apiCredentials
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Name == "" || req.Password == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name and password are required")
+	}
+	userID, err := register(c.Request().Context(), req.Name, req.Password)
+	if err != nil {
+		if merr, ok := err.(*mysql.MySQLError); ok {
+			if merr.Number == 1062 { // Duplicate entry xxxx for key zzzz
+				return echo.NewHTTPError(http.StatusConflict, "name is already taken")
+			}
+		}
+		return err
+	}
+	user, err := getUser(c.Request().Context(), userID)
+	if err != nil {
+		return err
+	}
+	if err := sessSetUserID(c, userID); err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/api/v1/users/"+user.Name)
+	return c.JSON(http.StatusCreated, user)
+}
+
+func apiPostLogin(c echo.Context) error {
+	var req apiCredentials
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Name == "" || req.Password == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name and password are required")
+	}
+	if err := limitLoginAccount(c, req.Name); err != nil {
+		return err
+	}
+	user, err := authenticate(c.Request().Context(), req.Name, req.Password)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid name or password")
+	}
+	if err := sessSetUserID(c, user.ID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func apiGetMySessions(c echo.Context) error {
+	sessions, err := querySessions(apiUser(c).ID, sessID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, sessions)
+}
+
+func apiDeleteMySession(c echo.Context) error {
+	if err := revokeSession(apiUser(c).ID, c.Param("handle")); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// apiDeleteMySessions logs the user out everywhere, including this client.
+func apiDeleteMySessions(c echo.Context) error {
+	if err := sessionStore.Backend.DeleteByUser(apiUser(c).ID); err != nil {
+		return err
+	}
+	sessClearUserID(c)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func apiPostLogout(c echo.Context) error {
+	sessClearUserID(c)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// apiGetCSRFToken returns the token to send as the X-CSRF-Token header
+// with every POST, PUT, PATCH and DELETE request. The token changes on login
+// and logout; the new one comes in the X-CSRF-Token header of the response.
+func apiGetCSRFToken(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{"csrf_token": csrfToken(c)})
+}
+
+func apiGetMe(c echo.Context) error {
+	return c.JSON(http.StatusOK, apiUser(c))
+}
+
+func apiPatchMe(c echo.Context) error {
+	self := apiUser(c)
+	var req struct {
+		DisplayName string `json:"display_name" form:"display_name"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.DisplayName == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "display_name is required")
+	}
+	_, err := db.ExecContext(c.Request().Context(), "UPDATE user SET display_name = ? WHERE id = ?", req.DisplayName, self.ID)
+	if err != nil {
+		return err
+	}
+	self.DisplayName = req.DisplayName
+	return c.JSON(http.StatusOK, self)
+}
+
+// apiPutMyAvatar takes the image as the multipart field "avatar_icon", like POST /profile.
+func apiPutMyAvatar(c echo.Context) error {
+	self := apiUser(c)
+	fh, err := c.FormFile("avatar_icon")
+	if err == http.ErrMissingFile {
+		return echo.NewHTTPError(http.StatusBadRequest, "avatar_icon is required")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := updateAvatar(c.Request().Context(), self.ID, fh); err != nil {
+		return err
+	}
+	user, err := getUser(c.Request().Context(), self.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func apiGetMyMentions(c echo.Context) error {
+	mentions, err := queryRecentMentions(c.Request().Context(), apiUser(c).ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, mentions)
+}
+
+func apiGetUser(c echo.Context) error {
+	user, err := getUserByName(c.Request().Context(), c.Param("user_name"))
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func apiGetChannels(c echo.Context) error {
+	channels, err := queryChannelInfos(c.Request().Context(), apiUser(c).ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, channels)
+}
+
+func apiPostChannels(c echo.Context) error {
+	var req struct {
+		Name        string `json:"name" form:"name"`
+		Description string `json:"description" form:"description"`
+		IsPrivate   bool   `json:"is_private" form:"is_private"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Name == "" || req.Description == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name and description are required")
+	}
+	chID, err := addChannel(c.Request().Context(), req.Name, req.Description, req.IsPrivate, apiUser(c).ID)
+	if err != nil {
+		return err
+	}
+	ch, err := getChannelInfo(c.Request().Context(), chID)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/v1/channels/%d", chID))
+	return c.JSON(http.StatusCreated, ch)
+}
+
+// apiPatchChannel updates name and description, and archives or unarchives the
+// channel with is_archived. Omitted fields are left unchanged.
+func apiPatchChannel(c echo.Context) error {
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	ch, err := manageableChannel(c.Request().Context(), apiUser(c), chID)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		IsArchived  *bool   `json:"is_archived"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Name != nil || req.Description != nil {
+		name, desc := ch.Name, ch.Description
+		if req.Name != nil {
+			name = *req.Name
+		}
+		if req.Description != nil {
+			desc = *req.Description
+		}
+		if name == "" || desc == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "name and description must not be empty")
+		}
+		if err := updateChannel(c.Request().Context(), ch.ID, name, desc); err != nil {
+			return err
+		}
+	}
+	if req.IsArchived != nil {
+		if err := archiveChannel(c.Request().Context(), ch.ID, *req.IsArchived); err != nil {
+			return err
+		}
+	}
+	ch, err = getChannelInfo(c.Request().Context(), ch.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, ch)
+}
+
+func apiDeleteChannel(c echo.Context) error {
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	ch, err := manageableChannel(c.Request().Context(), apiUser(c), chID)
+	if err != nil {
+		return err
+	}
+	if err := deleteChannel(c.Request().Context(), ch.ID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func apiGetChannel(c echo.Context) error {
+	ch, err := apiChannelParam(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, ch)
+}
+
+// apiGetMessages behaves like GET /message: it returns up to 100 messages newer than
+// last_message_id, oldest first, and marks them as read.
+func apiGetMessages(c echo.Context) error {
+	ch, err := apiChannelParam(c)
+	if err != nil {
+		return err
+	}
+	var lastID int64
+	if s := c.QueryParam("last_message_id"); s != "" {
+		lastID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || lastID < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid last_message_id")
+		}
+	}
+	messages, err := readMessages(c.Request().Context(), apiUser(c).ID, ch.ID, lastID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, messages)
+}
+
+func apiPostMessages(c echo.Context) error {
+	ch, err := apiChannelParam(c)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Message string `json:"message" form:"message"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Message == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
+	}
+	id, err := addMessage(c.Request().Context(), ch.ID, apiUser(c).ID, req.Message)
+	if err != nil {
+		return err
+	}
+	m, err := getMessageByID(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	r, err := jsonifyMessage(c.Request().Context(), *m)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, r)
+}
+
+func apiPutMessage(c echo.Context) error {
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Message string `json:"message" form:"message"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Message == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
+	}
+	m, err := editMessage(c.Request().Context(), apiUser(c).ID, msgID, req.Message)
+	if err != nil {
+		return err
+	}
+	r, err := jsonifyMessage(c.Request().Context(), *m)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+func apiDeleteMessage(c echo.Context) error {
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+	if err := removeMessage(c.Request().Context(), apiUser(c).ID, msgID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// apiGetReplies behaves like GET /thread/:message_id.
+func apiGetReplies(c echo.Context) error {
+	return getThread(c)
+}
+
+func apiPostReplies(c echo.Context) error {
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Message string `json:"message" form:"message"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Message == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
+	}
+	parent, err := getMessageByID(c.Request().Context(), msgID)
+	if err != nil {
+		return err
+	}
+	if parent == nil || checkChannelAccess(c.Request().Context(), apiUser(c).ID, parent.ChannelID) != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "message not found")
+	}
+	id, err := addReply(c.Request().Context(), parent.ID, parent.ChannelID, apiUser(c).ID, req.Message)
+	if err != nil {
+		return err
+	}
+	m, err := getMessageByID(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	r, err := jsonifyMessage(c.Request().Context(), *m)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, r)
+}
+
+func apiGetHistory(c echo.Context) error {
+	ch, err := apiChannelParam(c)
+	if err != nil {
+		return err
+	}
+	cur, err := parseHistoryCursor(c)
+	if err != nil {
+		return err
+	}
+	page, err := queryHistoryPage(c.Request().Context(), ch.ID, cur)
+	if err == errHistoryPageNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "page out of range")
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"messages":        page.Messages,
+		"older_before_id": page.OlderBeforeID,
+		"newer_after_id":  page.NewerAfterID,
+	})
+}
+
+// apiGetSearch takes the same parameters as GET /search.
+func apiGetSearch(c echo.Context) error {
+	q, err := parseSearchQuery(c, apiUser(c).ID)
+	if err != nil {
+		return err
+	}
+	messages, nextID, err := runSearch(c.Request().Context(), q)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"messages":       messages,
+		"next_before_id": nextID,
+	})
+}
+
+// apiGetMembers returns the members of a private channel.
+func apiGetMembers(c echo.Context) error {
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	ch, err := privateChannelOf(c.Request().Context(), apiUser(c).ID, chID)
+	if err != nil {
+		return err
+	}
+	members, err := queryChannelMembers(c.Request().Context(), ch.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, members)
+}
+
+// apiPostMembers invites the user {"name": ...} to a private channel.
+func apiPostMembers(c echo.Context) error {
+	var req struct {
+		Name string `json:"name" form:"name"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	user, err := inviteMember(c.Request().Context(), apiUser(c).ID, chID, req.Name)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, user)
+}
+
+// apiDeleteMember leaves a private channel when :user_name is the user,
+// and removes the member otherwise.
+func apiDeleteMember(c echo.Context) error {
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	if err := removeMember(c.Request().Context(), apiUser(c).ID, chID, c.Param("user_name")); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func apiGetDirects(c echo.Context) error {
+	channels, err := queryDirectChannels(c.Request().Context(), apiUser(c).ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, channels)
+}
+
+// apiPostDirects opens the direct message channel with {"names": [...]}.
+// The same channel is returned for the same set of users.
+func apiPostDirects(c echo.Context) error {
+	var req struct {
+		Names []string `json:"names" form:"names"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if len(req.Names) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "names are required")
+	}
+	chID, err := openDirect(c.Request().Context(), apiUser(c).ID, req.Names)
+	if err != nil {
+		return err
+	}
+	ch, err := getChannelInfo(c.Request().Context(), chID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, ch)
+}
+
+func apiGetUnread(c echo.Context) error {
+	resp, err := unreadCounts(c.Request().Context(), apiUser(c).ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func routeAPI(e *echo.Echo) {
+	g := e.Group("/api/v1")
+	g.Use(apiErrorHandler)
+
+	g.GET("/csrf_token", apiGetCSRFToken)
+	g.POST("/users", apiPostUsers, rateLimit("register"))
+	g.POST("/login", apiPostLogin, rateLimit("login"))
+	g.POST("/logout", apiPostLogout)
+
+	g.GET("/me", apiGetMe, apiAuth)
+	g.PATCH("/me", apiPatchMe, apiAuth)
+	g.PUT("/me/avatar", apiPutMyAvatar, apiAuth)
+	g.GET("/me/mentions", apiGetMyMentions, apiAuth)
+	g.GET("/me/sessions", apiGetMySessions, apiAuth)
+	g.DELETE("/me/sessions", apiDeleteMySessions, apiAuth)
+	g.DELETE("/me/sessions/:handle", apiDeleteMySession, apiAuth)
+	g.GET("/users/:user_name", apiGetUser, apiAuth)
+
+	g.GET("/channels", apiGetChannels, apiAuth)
+	g.POST("/channels", apiPostChannels, apiAuth)
+	g.GET("/channels/:channel_id", apiGetChannel, apiAuth)
+	g.PATCH("/channels/:channel_id", apiPatchChannel, apiAuth)
+	g.DELETE("/channels/:channel_id", apiDeleteChannel, apiAuth)
+	g.GET("/channels/:channel_id/messages", apiGetMessages, apiAuth)
+	g.POST("/channels/:channel_id/messages", apiPostMessages, apiAuth, rateLimit("message"))
+	g.GET("/channels/:channel_id/history", apiGetHistory, apiAuth)
+	g.GET("/channels/:channel_id/members", apiGetMembers, apiAuth)
+	g.POST("/channels/:channel_id/members", apiPostMembers, apiAuth)
+	g.DELETE("/channels/:channel_id/members/:user_name", apiDeleteMember, apiAuth)
+	g.GET("/dms", apiGetDirects, apiAuth)
+	g.POST("/dms", apiPostDirects, apiAuth)
+	g.PUT("/messages/:message_id", apiPutMessage, apiAuth)
+	g.DELETE("/messages/:message_id", apiDeleteMessage, apiAuth)
+	g.GET("/messages/:message_id/edits", getMessageEdits, apiAuth)
+	g.GET("/messages/:message_id/replies", apiGetReplies, apiAuth)
+	g.POST("/messages/:message_id/reactions", postReaction, apiAuth)
+	g.DELETE("/messages/:message_id/reactions", deleteReaction, apiAuth)
+	g.POST("/messages/:message_id/replies", apiPostReplies, apiAuth, rateLimit("message"))
+	g.GET("/unread", apiGetUnread, apiAuth)
+	g.GET("/search", apiGetSearch, apiAuth)
+}
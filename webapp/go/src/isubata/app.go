@@ -1,22 +1,27 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"crypto/sha1"
 	"database/sql"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"isubata/config"
+
 	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
@@ -26,10 +31,11 @@ import (
 )
 
 const (
-	avatarMaxBytes = 1 * 1024 * 1024
+	fetchPollTimeout = 30 * time.Second
 )
 
 var (
+	cfg           *config.Config
 	db            *sqlx.DB
 	ErrBadReqeust = echo.NewHTTPError(http.StatusBadRequest)
 )
@@ -39,6 +45,9 @@ type Renderer struct {
 }
 
 func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	if m, ok := data.(map[string]interface{}); ok {
+		m["CSRFToken"] = csrfToken(c)
+	}
 	return r.templates.ExecuteTemplate(w, name, data)
 }
 
@@ -46,41 +55,38 @@ func init() {
 	seedBuf := make([]byte, 8)
 	crand.Read(seedBuf)
 	rand.Seed(int64(binary.LittleEndian.Uint64(seedBuf)))
+}
 
-	db_host := os.Getenv("ISUBATA_DB_HOST")
-	if db_host == "" {
-		db_host = "127.0.0.1"
-	}
-	db_port := os.Getenv("ISUBATA_DB_PORT")
-	if db_port == "" {
-		db_port = "3306"
-	}
-	db_user := os.Getenv("ISUBATA_DB_USER")
-	if db_user == "" {
-		db_user = "root"
+// connectDB opens the database and waits until it answers, for at most ConnectTimeout.
+func connectDB(c config.DBConfig) error {
+	dsn := c.DSN()
+	if c.Password != "" {
+		dsn = strings.Replace(dsn, ":"+c.Password+"@", ":***@", 1)
 	}
-	db_password := os.Getenv("ISUBATA_DB_PASSWORD")
-	if db_password != "" {
-		db_password = ":" + db_password
-	}
-
-	dsn := fmt.Sprintf("%s%s@tcp(%s:%s)/isubata?parseTime=true&loc=Local&charset=utf8mb4",
-		db_user, db_password, db_host, db_port)
-
 	log.Printf("Connecting to db: %q", dsn)
-	db, _ = sqlx.Connect("mysql", dsn)
+
+	sqlDB, err := sql.Open("isubata-mysql", c.DSN())
+	if err != nil {
+		return err
+	}
+	db = sqlx.NewDb(sqlDB, "mysql")
+	deadline := time.Now().Add(time.Duration(c.ConnectTimeout))
 	for {
-		err := db.Ping()
+		err = db.Ping()
 		if err == nil {
 			break
 		}
 		log.Println(err)
+		if time.Now().After(deadline) {
+			return fmt.Errorf("db %s:%d is not reachable after %v: %v", c.Host, c.Port, c.ConnectTimeout, err)
+		}
 		time.Sleep(time.Second * 3)
 	}
 
-	db.SetMaxOpenConns(20)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetConnMaxLifetime(time.Duration(c.ConnMaxLifetime))
 	log.Printf("Succeeded to connect db.")
+	return nil
 }
 
 type User struct {
@@ -90,12 +96,13 @@ type User struct {
 	Password    string    `json:"-" db:"password"`
 	DisplayName string    `json:"display_name" db:"display_name"`
 	AvatarIcon  string    `json:"avatar_icon" db:"avatar_icon"`
+	IsAdmin     bool      `json:"-" db:"is_admin"`
 	CreatedAt   time.Time `json:"-" db:"created_at"`
 }
 
-func getUser(userID int64) (*User, error) {
+func getUser(ctx context.Context, userID int64) (*User, error) {
 	u := User{}
-	if err := db.Get(&u, "SELECT * FROM user WHERE id = ?", userID); err != nil {
+	if err := db.GetContext(ctx, &u, "SELECT * FROM user WHERE id = ?", userID); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -104,29 +111,70 @@ func getUser(userID int64) (*User, error) {
 	return &u, nil
 }
 
-func addMessage(channelID, userID int64, content string) (int64, error) {
-	res, err := db.Exec(
+func addMessage(ctx context.Context, channelID, userID int64, content string) (int64, error) {
+	if err := checkChannelWritable(ctx, channelID); err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Counting first locks the counter of the channel, so that messages get their
+	// IDs in the order they are counted, as readers of the counter expect.
+	if err := incrMessageCount(ctx, tx, channelID, 1); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx,
 		"INSERT INTO message (channel_id, user_id, content, created_at) VALUES (?, ?, ?, NOW())",
 		channelID, userID, content)
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := addMentions(ctx, tx, id, channelID, 0, userID, content); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	searchIndex.Add(id, content)
+	messagesPosted.Inc("message")
+	hub.Publish(Event{Type: EventPost, ChannelID: channelID, MessageID: id})
+	return id, nil
 }
 
+// Message is a row of the message table.
+// Deleted messages are kept as tombstones with DeletedAt set so that message IDs
+// used by last_message_id and haveread stay meaningful; they are never rendered.
+// Replies in a thread have the ID of the top-level message as ParentID, and are
+// left out of the channel timeline.
 type Message struct {
-	ID        int64     `db:"id"`
-	ChannelID int64     `db:"channel_id"`
-	UserID    int64     `db:"user_id"`
-	Content   string    `db:"content"`
-	CreatedAt time.Time `db:"created_at"`
+	ID          int64          `db:"id"`
+	ChannelID   int64          `db:"channel_id"`
+	UserID      int64          `db:"user_id"`
+	Content     string         `db:"content"`
+	CreatedAt   time.Time      `db:"created_at"`
+	EditedAt    mysql.NullTime `db:"edited_at"`
+	DeletedAt   mysql.NullTime `db:"deleted_at"`
+	ParentID    int64          `db:"parent_id"`
+	ReplyCount  int64          `db:"reply_count"`
+	LastReplyAt mysql.NullTime `db:"last_reply_at"`
 }
 
-func queryMessages(chanID, lastID int64) ([]Message, error) {
-	msgs := []Message{}
-	err := db.Select(&msgs, "SELECT * FROM message WHERE id > ? AND channel_id = ? ORDER BY id DESC LIMIT 100",
-		lastID, chanID)
-	return msgs, err
+func getMessageByID(ctx context.Context, id int64) (*Message, error) {
+	m := Message{}
+	if err := db.GetContext(ctx, &m, "SELECT * FROM message WHERE id = ?", id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &m, nil
 }
 
 func sessUserID(c echo.Context) int64 {
@@ -138,14 +186,33 @@ func sessUserID(c echo.Context) int64 {
 	return userID
 }
 
-func sessSetUserID(c echo.Context, id int64) {
+func sessSetUserID(c echo.Context, id int64) error {
 	sess, _ := session.Get("session", c)
+	// Start a new session on login against session fixation.
+	if sess.ID != "" {
+		if err := sessionStore.Backend.Delete(sess.ID); err != nil {
+			return err
+		}
+		sess.ID = ""
+	}
 	sess.Options = &sessions.Options{
+		Path:     "/",
 		HttpOnly: true,
-		MaxAge:   360000,
+		MaxAge:   sessionMaxAge,
 	}
 	sess.Values["user_id"] = id
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+	issueCSRFToken(c)
+	return nil
+}
+
+func sessClearUserID(c echo.Context) {
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "user_id")
 	sess.Save(c.Request(), c.Response())
+	issueCSRFToken(c)
 }
 
 func ensureLogin(c echo.Context) (*User, error) {
@@ -157,14 +224,12 @@ func ensureLogin(c echo.Context) (*User, error) {
 		goto redirect
 	}
 
-	user, err = getUser(userID)
+	user, err = getUser(c.Request().Context(), userID)
 	if err != nil {
 		return nil, err
 	}
 	if user == nil {
-		sess, _ := session.Get("session", c)
-		delete(sess.Values, "user_id")
-		sess.Save(c.Request(), c.Response())
+		sessClearUserID(c)
 		goto redirect
 	}
 	return user, nil
@@ -186,28 +251,86 @@ func randomString(n int) string {
 	return string(b)
 }
 
-func register(name, password string) (int64, error) {
-	salt := randomString(20)
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(salt+password)))
+func register(ctx context.Context, name, password string) (int64, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
 
-	res, err := db.Exec(
+	res, err := db.ExecContext(ctx,
 		"INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
-			" VALUES (?, ?, ?, ?, ?, NOW())",
-		name, salt, digest, name, "default.png")
+			" VALUES (?, '', ?, ?, ?, NOW())",
+		name, hash, name, "default.png")
 	if err != nil {
 		return 0, err
 	}
 	return res.LastInsertId()
 }
 
+// authenticate returns nil if the name or the password is wrong.
+// Legacy password hashes are upgraded on success.
+func authenticate(ctx context.Context, name, password string) (*User, error) {
+	var user User
+	err := db.GetContext(ctx, &user, "SELECT * FROM user WHERE name = ?", name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ok, rehash := checkPassword(&user, password)
+	if !ok {
+		return nil, nil
+	}
+	if rehash {
+		if err := upgradePassword(ctx, &user, password); err != nil {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func getUserByName(ctx context.Context, name string) (*User, error) {
+	u := User{}
+	if err := db.GetContext(ctx, &u, "SELECT * FROM user WHERE name = ?", name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
 // request handlers
 
 func getInitialize(c echo.Context) error {
-	db.MustExec("DELETE FROM user WHERE id > 1000")
-	db.MustExec("DELETE FROM image WHERE id > 1001")
-	db.MustExec("DELETE FROM channel WHERE id > 10")
-	db.MustExec("DELETE FROM message WHERE id > 10000")
-	db.MustExec("DELETE FROM haveread")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM user WHERE id > 1000")
+	// The IDs of the deleted users may be given again to new users.
+	if err := sessionStore.Backend.DeleteAll(); err != nil {
+		return err
+	}
+	if err := resetImages(c.Request().Context()); err != nil {
+		return err
+	}
+	db.MustExecContext(c.Request().Context(), "DELETE FROM channel WHERE id > 10")
+	db.MustExecContext(c.Request().Context(), "UPDATE channel SET is_archived = 0 WHERE is_archived = 1")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM channel_member")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM message WHERE id > 10000")
+	// restore the initial messages edited or deleted during the previous run
+	db.MustExecContext(c.Request().Context(), "UPDATE message m JOIN message_edit e ON e.message_id = m.id"+
+		" SET m.content = e.content"+
+		" WHERE e.id = (SELECT MIN(id) FROM message_edit WHERE message_id = m.id)")
+	db.MustExecContext(c.Request().Context(), "UPDATE message SET edited_at = NULL, deleted_at = NULL"+
+		" WHERE edited_at IS NOT NULL OR deleted_at IS NOT NULL")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM message_edit")
+	db.MustExecContext(c.Request().Context(), "UPDATE message SET reply_count = 0, last_reply_at = NULL WHERE reply_count > 0")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM haveread")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM thread_haveread")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM reaction")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM reaction_log")
+	db.MustExecContext(c.Request().Context(), "DELETE FROM mention")
+	resetMessageCounts(c.Request().Context())
+	go rebuildSearchIndex()
 	return c.String(204, "")
 }
 
@@ -223,11 +346,75 @@ func getIndex(c echo.Context) error {
 }
 
 type ChannelInfo struct {
-	ID          int64     `db:"id"`
-	Name        string    `db:"name"`
-	Description string    `db:"description"`
-	UpdatedAt   time.Time `db:"updated_at"`
-	CreatedAt   time.Time `db:"created_at"`
+	ID          int64  `json:"id" db:"id"`
+	Name        string `json:"name" db:"name"`
+	Description string `json:"description" db:"description"`
+	IsPrivate   bool   `json:"is_private" db:"is_private"`
+	IsDirect    bool   `json:"is_direct" db:"is_direct"`
+	// DirectKey identifies the members of a direct message channel.
+	DirectKey  sql.NullString `json:"-" db:"direct_key"`
+	IsArchived bool           `json:"is_archived" db:"is_archived"`
+	OwnerID    int64          `json:"owner_id" db:"owner_id"`
+	UpdatedAt  time.Time      `json:"updated_at" db:"updated_at"`
+	CreatedAt  time.Time      `json:"created_at" db:"created_at"`
+}
+
+// queryChannelInfos returns the channels visible to the user:
+// every public channel and the private channels the user is a member of.
+// Direct messages are not included.
+func queryChannelInfos(ctx context.Context, userID int64) ([]ChannelInfo, error) {
+	channels := []ChannelInfo{}
+	err := db.SelectContext(ctx, &channels,
+		"SELECT c.* FROM channel c"+
+			" LEFT JOIN channel_member m ON m.channel_id = c.id AND m.user_id = ?"+
+			" WHERE c.is_direct = 0 AND (c.is_private = 0 OR m.user_id IS NOT NULL) ORDER BY c.id",
+		userID)
+	return channels, err
+}
+
+func getChannelInfo(ctx context.Context, chID int64) (*ChannelInfo, error) {
+	ch := ChannelInfo{}
+	if err := db.GetContext(ctx, &ch, "SELECT * FROM channel WHERE id = ?", chID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// addChannel creates a channel owned by the user.
+// The owner is the first member of a private channel.
+func addChannel(ctx context.Context, name, desc string, private bool, ownerID int64) (int64, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO channel (name, description, is_private, owner_id, updated_at, created_at)"+
+			" VALUES (?, ?, ?, ?, NOW(), NOW())",
+		name, desc, private, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if private {
+		_, err := tx.ExecContext(ctx, "INSERT INTO channel_member (channel_id, user_id, created_at) VALUES (?, ?, NOW())",
+			id, ownerID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	hub.Publish(Event{Type: EventChannel, ChannelID: id})
+	return id, nil
 }
 
 func getChannel(c echo.Context) error {
@@ -235,28 +422,42 @@ func getChannel(c echo.Context) error {
 	if user == nil {
 		return err
 	}
-	cID, err := strconv.Atoi(c.Param("channel_id"))
+	cID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
 	if err != nil {
 		return err
 	}
-	channels := []ChannelInfo{}
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	if err := checkChannelAccess(c.Request().Context(), user.ID, cID); err != nil {
+		return err
+	}
+	channels, err := queryChannelInfos(c.Request().Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	directs, err := queryDirectChannels(c.Request().Context(), user.ID)
 	if err != nil {
 		return err
 	}
 
-	var desc string
-	for _, ch := range channels {
-		if ch.ID == int64(cID) {
-			desc = ch.Description
-			break
+	channel, err := getChannelInfo(c.Request().Context(), cID)
+	if err != nil {
+		return err
+	}
+	var members []User
+	if channel.IsPrivate {
+		members, err = queryChannelMembers(c.Request().Context(), cID)
+		if err != nil {
+			return err
 		}
 	}
 	return c.Render(http.StatusOK, "channel", map[string]interface{}{
 		"ChannelID":   cID,
 		"Channels":    channels,
+		"Directs":     directs,
 		"User":        user,
-		"Description": desc,
+		"Description": channel.Description,
+		"Channel":     channel,
+		"Members":     members,
+		"CanManage":   !channel.IsDirect && (channel.OwnerID == user.ID || user.IsAdmin),
 	})
 }
 
@@ -274,7 +475,7 @@ func postRegister(c echo.Context) error {
 	if name == "" || pw == "" {
 		return ErrBadReqeust
 	}
-	userID, err := register(name, pw)
+	userID, err := register(c.Request().Context(), name, pw)
 	if err != nil {
 		if merr, ok := err.(*mysql.MySQLError); ok {
 			if merr.Number == 1062 { // Duplicate entry xxxx for key zzzz
@@ -283,7 +484,9 @@ func postRegister(c echo.Context) error {
 		}
 		return err
 	}
-	sessSetUserID(c, userID)
+	if err := sessSetUserID(c, userID); err != nil {
+		return err
+	}
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
@@ -301,27 +504,25 @@ func postLogin(c echo.Context) error {
 	if name == "" || pw == "" {
 		return ErrBadReqeust
 	}
-
-	var user User
-	err := db.Get(&user, "SELECT * FROM user WHERE name = ?", name)
-	if err == sql.ErrNoRows {
-		return echo.ErrForbidden
-	} else if err != nil {
+	if err := limitLoginAccount(c, name); err != nil {
 		return err
 	}
 
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+pw)))
-	if digest != user.Password {
+	user, err := authenticate(c.Request().Context(), name, pw)
+	if err != nil {
+		return err
+	}
+	if user == nil {
 		return echo.ErrForbidden
 	}
-	sessSetUserID(c, user.ID)
+	if err := sessSetUserID(c, user.ID); err != nil {
+		return err
+	}
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
-func getLogout(c echo.Context) error {
-	sess, _ := session.Get("session", c)
-	delete(sess.Values, "user_id")
-	sess.Save(c.Request(), c.Response())
+func postLogout(c echo.Context) error {
+	sessClearUserID(c)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
@@ -342,28 +543,26 @@ func postMessage(c echo.Context) error {
 	} else {
 		chanID = int64(x)
 	}
-
-	if _, err := addMessage(chanID, user.ID, message); err != nil {
+	if err := checkChannelAccess(c.Request().Context(), user.ID, chanID); err != nil {
 		return err
 	}
 
-	return c.NoContent(204)
-}
+	if s := c.FormValue("parent_id"); s != "" && s != "0" {
+		parentID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return echo.ErrForbidden
+		}
+		if _, err := addReply(c.Request().Context(), parentID, chanID, user.ID, message); err != nil {
+			return err
+		}
+		return c.NoContent(204)
+	}
 
-func jsonifyMessage(m Message) (map[string]interface{}, error) {
-	u := User{}
-	err := db.Get(&u, "SELECT name, display_name, avatar_icon FROM user WHERE id = ?",
-		m.UserID)
-	if err != nil {
-		return nil, err
+	if _, err := addMessage(c.Request().Context(), chanID, user.ID, message); err != nil {
+		return err
 	}
 
-	r := make(map[string]interface{})
-	r["id"] = m.ID
-	r["user"] = u
-	r["date"] = m.CreatedAt.Format("2006/01/02 15:04:05")
-	r["content"] = m.Content
-	return r, nil
+	return c.NoContent(204)
 }
 
 func getMessage(c echo.Context) error {
@@ -380,103 +579,102 @@ func getMessage(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-
-	messages, err := queryMessages(chanID, lastID)
-	if err != nil {
+	if err := checkChannelAccess(c.Request().Context(), userID, chanID); err != nil {
 		return err
 	}
 
-	response := make([]map[string]interface{}, 0)
-	for i := len(messages) - 1; i >= 0; i-- {
-		m := messages[i]
-		r, err := jsonifyMessage(m)
-		if err != nil {
-			return err
-		}
-		response = append(response, r)
-	}
-
-	if len(messages) > 0 {
-		_, err := db.Exec("INSERT INTO haveread (user_id, channel_id, message_id, updated_at, created_at)"+
-			" VALUES (?, ?, ?, NOW(), NOW())"+
-			" ON DUPLICATE KEY UPDATE message_id = ?, updated_at = NOW()",
-			userID, chanID, messages[0].ID, messages[0].ID)
-		if err != nil {
-			return err
-		}
+	response, err := readMessages(c.Request().Context(), userID, chanID, lastID)
+	if err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, response)
 }
 
-func queryChannels() ([]int64, error) {
+// queryChannels returns the IDs of the channels visible to the user.
+func queryChannels(ctx context.Context, userID int64) ([]int64, error) {
 	res := []int64{}
-	err := db.Select(&res, "SELECT id FROM channel")
+	err := db.SelectContext(ctx, &res,
+		"SELECT c.id FROM channel c"+
+			" LEFT JOIN channel_member m ON m.channel_id = c.id AND m.user_id = ?"+
+			" WHERE c.is_private = 0 OR m.user_id IS NOT NULL",
+		userID)
 	return res, err
 }
 
-func queryHaveRead(userID, chID int64) (int64, error) {
-	type HaveRead struct {
-		UserID    int64     `db:"user_id"`
-		ChannelID int64     `db:"channel_id"`
-		MessageID int64     `db:"message_id"`
-		UpdatedAt time.Time `db:"updated_at"`
-		CreatedAt time.Time `db:"created_at"`
-	}
-	h := HaveRead{}
-
-	err := db.Get(&h, "SELECT * FROM haveread WHERE user_id = ? AND channel_id = ?",
-		userID, chID)
-
-	if err == sql.ErrNoRows {
-		return 0, nil
-	} else if err != nil {
-		return 0, err
-	}
-	return h.MessageID, nil
-}
-
+// fetchUnread returns the unread counts of every channel visible to the user.
+//
+// With a since parameter it works in long-polling mode: the request blocks until
+// a message is posted to one of those channels after the version since, or the set of
+// those channels changes, and the response carries the new version to pass as since
+// in the next request:
+//
+//	{"version": 1508000000000042, "unread": [{"channel_id": 1, "unread": 3}, ...]}
+//
+// since=0 returns immediately. If nothing changes within fetchPollTimeout,
+// 204 No Content is returned and the client should retry with the same token.
 func fetchUnread(c echo.Context) error {
 	userID := sessUserID(c)
 	if userID == 0 {
 		return c.NoContent(http.StatusForbidden)
 	}
 
-	time.Sleep(time.Second)
-
-	channels, err := queryChannels()
-	if err != nil {
-		return err
-	}
-
-	resp := []map[string]interface{}{}
+	sinceStr := c.QueryParam("since")
+	if sinceStr == "" {
+		time.Sleep(time.Second)
 
-	for _, chID := range channels {
-		lastID, err := queryHaveRead(userID, chID)
+		resp, err := unreadCounts(c.Request().Context(), userID)
 		if err != nil {
 			return err
 		}
+		return c.JSON(http.StatusOK, resp)
+	}
 
-		var cnt int64
-		if lastID > 0 {
-			err = db.Get(&cnt,
-				"SELECT COUNT(*) as cnt FROM message WHERE channel_id = ? AND ? < id",
-				chID, lastID)
-		} else {
-			err = db.Get(&cnt,
-				"SELECT COUNT(*) as cnt FROM message WHERE channel_id = ?",
-				chID)
+	since, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil || since < 0 {
+		return ErrBadReqeust
+	}
+
+	visible := &channelSet{}
+	if _, err := visible.load(c.Request().Context(), userID); err != nil {
+		return err
+	}
+	// Invitations, kicks and new channels change the visible channels while waiting.
+	sub := hub.Subscribe(func(ev Event) bool { return ev.Type == EventMember || ev.Type == EventChannel })
+	defer hub.Unsubscribe(sub)
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), fetchPollTimeout)
+	defer cancel()
+	var version int64
+	for {
+		var changed bool
+		version, changed = hub.Wait(ctx, since, func(chID int64) bool { return visible.has(chID) || len(sub.C) > 0 })
+		if !changed {
+			return c.NoContent(http.StatusNoContent)
+		}
+		if len(sub.C) == 0 {
+			break
+		}
+		for len(sub.C) > 0 {
+			<-sub.C
 		}
+		reloaded, err := visible.load(c.Request().Context(), userID)
 		if err != nil {
 			return err
 		}
-		r := map[string]interface{}{
-			"channel_id": chID,
-			"unread":     cnt}
-		resp = append(resp, r)
+		if reloaded {
+			break
+		}
 	}
 
-	return c.JSON(http.StatusOK, resp)
+	resp, err := unreadCounts(c.Request().Context(), userID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"version": version,
+		"unread":  resp,
+	})
 }
 
 func getHistory(c echo.Context) error {
@@ -489,51 +687,48 @@ func getHistory(c echo.Context) error {
 	if user == nil {
 		return err
 	}
-
-	var page int64
-	pageStr := c.QueryParam("page")
-	if pageStr == "" {
-		page = 1
-	} else {
-		page, err = strconv.ParseInt(pageStr, 10, 64)
-		if err != nil || page < 1 {
-			return ErrBadReqeust
-		}
+	if err := checkChannelAccess(c.Request().Context(), user.ID, chID); err != nil {
+		return err
 	}
 
-	const N = 20
-	var cnt int64
-	err = db.Get(&cnt, "SELECT COUNT(*) as cnt FROM message WHERE channel_id = ?", chID)
+	cur, err := parseHistoryCursor(c)
 	if err != nil {
 		return err
 	}
-	maxPage := int64(cnt+N-1) / N
-	if maxPage == 0 {
-		maxPage = 1
-	}
-	if page > maxPage {
+	page, err := queryHistoryPage(c.Request().Context(), chID, cur)
+	if err == errHistoryPageNotFound {
 		return ErrBadReqeust
+	} else if err != nil {
+		return err
 	}
 
-	messages := []Message{}
-	err = db.Select(&messages,
-		"SELECT * FROM message WHERE channel_id = ? ORDER BY id DESC LIMIT ? OFFSET ?",
-		chID, N, (page-1)*N)
+	// The numbered pager marks the current page, and links its neighbors with « and »,
+	// unless the page was reached with a cursor.
+	maxPage, err := historyPageCount(c.Request().Context(), chID)
 	if err != nil {
 		return err
 	}
-
-	mjson := make([]map[string]interface{}, 0)
-	for i := len(messages) - 1; i >= 0; i-- {
-		r, err := jsonifyMessage(messages[i])
-		if err != nil {
-			return err
-		}
-		mjson = append(mjson, r)
+	pages := make([]int64, 0, maxPage)
+	for p := int64(1); p <= maxPage; p++ {
+		pages = append(pages, p)
+	}
+	current := cur.Page
+	if cur == (HistoryCursor{}) {
+		current = 1
+	}
+	var prevPage, nextPage int64
+	if current > 1 {
+		prevPage = current - 1
+	}
+	if current > 0 && current < maxPage {
+		nextPage = current + 1
 	}
 
-	channels := []ChannelInfo{}
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	channels, err := queryChannelInfos(c.Request().Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	directs, err := queryDirectChannels(c.Request().Context(), user.ID)
 	if err != nil {
 		return err
 	}
@@ -541,9 +736,15 @@ func getHistory(c echo.Context) error {
 	return c.Render(http.StatusOK, "history", map[string]interface{}{
 		"ChannelID": chID,
 		"Channels":  channels,
-		"Messages":  mjson,
-		"MaxPage":   maxPage,
-		"Page":      page,
+		"Directs":   directs,
+		"Messages":  page.Messages,
+		"Page":      current,
+		"Pages":     pages,
+		"PrevPage":  prevPage,
+		"NextPage":  nextPage,
+		"OlderID":   page.OlderBeforeID,
+		"NewerID":   page.NewerAfterID,
+		"Date":      c.QueryParam("date"),
 		"User":      user,
 	})
 }
@@ -554,28 +755,44 @@ func getProfile(c echo.Context) error {
 		return err
 	}
 
-	channels := []ChannelInfo{}
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	channels, err := queryChannelInfos(c.Request().Context(), self.ID)
 	if err != nil {
 		return err
 	}
-
-	userName := c.Param("user_name")
-	var other User
-	err = db.Get(&other, "SELECT * FROM user WHERE name = ?", userName)
-	if err == sql.ErrNoRows {
-		return echo.ErrNotFound
+	directs, err := queryDirectChannels(c.Request().Context(), self.ID)
+	if err != nil {
+		return err
 	}
+
+	other, err := getUserByName(c.Request().Context(), c.Param("user_name"))
 	if err != nil {
 		return err
 	}
+	if other == nil {
+		return echo.ErrNotFound
+	}
+
+	var mentions, logins []map[string]interface{}
+	if self.ID == other.ID {
+		mentions, err = queryRecentMentions(c.Request().Context(), self.ID)
+		if err != nil {
+			return err
+		}
+		logins, err = querySessions(self.ID, sessID(c))
+		if err != nil {
+			return err
+		}
+	}
 
 	return c.Render(http.StatusOK, "profile", map[string]interface{}{
 		"ChannelID":   0,
 		"Channels":    channels,
+		"Directs":     directs,
 		"User":        self,
 		"Other":       other,
 		"SelfProfile": self.ID == other.ID,
+		"Mentions":    mentions,
+		"Sessions":    logins,
 	})
 }
 
@@ -585,8 +802,11 @@ func getAddChannel(c echo.Context) error {
 		return err
 	}
 
-	channels := []ChannelInfo{}
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	channels, err := queryChannelInfos(c.Request().Context(), self.ID)
+	if err != nil {
+		return err
+	}
+	directs, err := queryDirectChannels(c.Request().Context(), self.ID)
 	if err != nil {
 		return err
 	}
@@ -594,6 +814,7 @@ func getAddChannel(c echo.Context) error {
 	return c.Render(http.StatusOK, "add_channel", map[string]interface{}{
 		"ChannelID": 0,
 		"Channels":  channels,
+		"Directs":   directs,
 		"User":      self,
 	})
 }
@@ -610,70 +831,62 @@ func postAddChannel(c echo.Context) error {
 		return ErrBadReqeust
 	}
 
-	res, err := db.Exec(
-		"INSERT INTO channel (name, description, updated_at, created_at) VALUES (?, ?, NOW(), NOW())",
-		name, desc)
+	lastID, err := addChannel(c.Request().Context(), name, desc, c.FormValue("private") != "", self.ID)
 	if err != nil {
 		return err
 	}
-	lastID, _ := res.LastInsertId()
 	return c.Redirect(http.StatusSeeOther,
 		fmt.Sprintf("/channel/%v", lastID))
 }
 
+// updateAvatar stores the uploaded image and sets it as the user's avatar.
+func updateAvatar(ctx context.Context, userID int64, fh *multipart.FileHeader) error {
+	file, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	avatarData, _ := ioutil.ReadAll(file)
+	file.Close()
+
+	if int64(len(avatarData)) > cfg.AvatarMaxBytes {
+		return ErrBadReqeust
+	}
+	if len(avatarData) == 0 {
+		return nil
+	}
+
+	avatarData, img, ext, err := processAvatar(avatarData, cfg.StripAvatarMetadata)
+	if err != nil {
+		return err
+	}
+	avatarName := fmt.Sprintf("%x%s", sha1.Sum(avatarData), ext)
+
+	if err := imageStore.Put(ctx, avatarName, avatarData); err != nil {
+		return err
+	}
+	if err := storeThumbnails(ctx, avatarName, img); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE user SET avatar_icon = ? WHERE id = ?", avatarName, userID)
+	return err
+}
+
 func postProfile(c echo.Context) error {
 	self, err := ensureLogin(c)
 	if self == nil {
 		return err
 	}
 
-	avatarName := ""
-	var avatarData []byte
-
 	if fh, err := c.FormFile("avatar_icon"); err == http.ErrMissingFile {
 		// no file upload
 	} else if err != nil {
 		return err
-	} else {
-		dotPos := strings.LastIndexByte(fh.Filename, '.')
-		if dotPos < 0 {
-			return ErrBadReqeust
-		}
-		ext := fh.Filename[dotPos:]
-		switch ext {
-		case ".jpg", ".jpeg", ".png", ".gif":
-			break
-		default:
-			return ErrBadReqeust
-		}
-
-		file, err := fh.Open()
-		if err != nil {
-			return err
-		}
-		avatarData, _ = ioutil.ReadAll(file)
-		file.Close()
-
-		if len(avatarData) > avatarMaxBytes {
-			return ErrBadReqeust
-		}
-
-		avatarName = fmt.Sprintf("%x%s", sha1.Sum(avatarData), ext)
-	}
-
-	if avatarName != "" && len(avatarData) > 0 {
-		_, err := db.Exec("INSERT INTO image (name, data) VALUES (?, ?)", avatarName, avatarData)
-		if err != nil {
-			return err
-		}
-		_, err = db.Exec("UPDATE user SET avatar_icon = ? WHERE id = ?", avatarName, self.ID)
-		if err != nil {
-			return err
-		}
+	} else if err := updateAvatar(c.Request().Context(), self.ID, fh); err != nil {
+		return err
 	}
 
 	if name := c.FormValue("display_name"); name != "" {
-		_, err := db.Exec("UPDATE user SET display_name = ? WHERE id = ?", name, self.ID)
+		_, err := db.ExecContext(c.Request().Context(), "UPDATE user SET display_name = ? WHERE id = ?", name, self.ID)
 		if err != nil {
 			return err
 		}
@@ -682,79 +895,166 @@ func postProfile(c echo.Context) error {
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
+// imageMimeType returns the type of the image by its extension, or "" if unknown.
+func imageMimeType(name string) string {
+	switch true {
+	case strings.HasSuffix(name, ".jpg"), strings.HasSuffix(name, ".jpeg"):
+		return "image/jpeg"
+	case strings.HasSuffix(name, ".png"):
+		return "image/png"
+	case strings.HasSuffix(name, ".gif"):
+		return "image/gif"
+	}
+	return ""
+}
+
+// getIcon returns the avatar, or its thumbnail of the given size.
+// Icons never change once stored, so they can be cached forever. Revalidations
+// are answered from the modification time of the avatar, without reading it.
 func getIcon(c echo.Context) error {
-	var name string
-	var data []byte
-	err := db.QueryRow("SELECT name, data FROM image WHERE name = ?",
-		c.Param("file_name")).Scan(&name, &data)
-	if err == sql.ErrNoRows {
+	name := c.Param("file_name")
+	if !validImageName.MatchString(name) {
 		return echo.ErrNotFound
 	}
-	if err != nil {
-		return err
+	size := 0
+	if sizeStr := c.QueryParam("size"); sizeStr != "" {
+		size, _ = strconv.Atoi(sizeStr)
+		if !validThumbnailSize(size) {
+			return ErrBadReqeust
+		}
 	}
 
-	mime := ""
-	switch true {
-	case strings.HasSuffix(name, ".jpg"), strings.HasSuffix(name, ".jpeg"):
-		mime = "image/jpeg"
-	case strings.HasSuffix(name, ".png"):
-		mime = "image/png"
-	case strings.HasSuffix(name, ".gif"):
-		mime = "image/gif"
-	default:
+	ctx := c.Request().Context()
+	modTime, err := imageStore.ModTime(ctx, name)
+	if err == errImageNotFound {
 		return echo.ErrNotFound
+	} else if err != nil {
+		return err
 	}
-	return c.Blob(http.StatusOK, mime, data)
-}
 
-func tAdd(a, b int64) int64 {
-	return a + b
-}
+	etag := iconETag(name, size)
+	h := c.Response().Header()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", iconCacheControl)
+	if notModified(c.Request(), etag, modTime) {
+		return c.NoContent(http.StatusNotModified)
+	}
 
-func tRange(a, b int64) []int64 {
-	r := make([]int64, b-a+1)
-	for i := int64(0); i <= (b - a); i++ {
-		r[i] = a + i
+	var data []byte
+	if size != 0 {
+		data, err = loadThumbnail(ctx, name, size)
+	} else {
+		data, err = imageStore.Get(ctx, name)
+	}
+	if err == nil && sniffImageType(data) == "" {
+		err = errImageNotFound
+	}
+	if err == errImageNotFound {
+		h.Del("ETag")
+		h.Del("Last-Modified")
+		h.Del("Cache-Control")
+		return echo.ErrNotFound
+	} else if err != nil {
+		return err
 	}
-	return r
+	return c.Blob(http.StatusOK, sniffImageType(data), data)
 }
 
 func main() {
-	e := echo.New()
-	funcs := template.FuncMap{
-		"add":    tAdd,
-		"xrange": tRange,
+	var err error
+	cfg, err = config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	setupLogging(cfg.LogLevel)
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+
+	if err := connectDB(cfg.DB); err != nil {
+		log.Fatal(err)
 	}
+	imageStore = newImageStore()
+
+	if len(cfg.Args) > 0 {
+		switch cfg.Args[0] {
+		case "migrate-images":
+			err = migrateImages()
+		default:
+			err = fmt.Errorf("unknown command %q", cfg.Args[0])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	e := echo.New()
 	e.Renderer = &Renderer{
-		templates: template.Must(template.New("").Funcs(funcs).ParseGlob("views/*.html")),
+		templates: template.Must(template.ParseGlob(cfg.Templates)),
 	}
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secretonymoris"))))
-	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: "request:\"${method} ${uri}\" status:${status} latency:${latency} (${latency_human}) bytes:${bytes_out}\n",
-	}))
-	e.Use(middleware.Static("../public"))
+	sessionStore = newSessionStore()
+	initTrustedProxies()
+	initRateLimiters()
+	e.Use(metricsMiddleware)
+	e.Use(session.Middleware(sessionStore))
+	e.Use(requestLogger)
+	e.Use(csrfProtect)
+	e.Use(middleware.Static(cfg.PublicDir))
 
 	e.GET("/initialize", getInitialize)
+	e.GET("/healthz", getHealthz)
+	e.GET("/readyz", getReadyz)
+	e.GET("/metrics", getMetrics)
 	e.GET("/", getIndex)
 	e.GET("/register", getRegister)
-	e.POST("/register", postRegister)
+	e.POST("/register", postRegister, rateLimit("register"))
 	e.GET("/login", getLogin)
-	e.POST("/login", postLogin)
-	e.GET("/logout", getLogout)
+	e.POST("/login", postLogin, rateLimit("login"))
+	e.POST("/logout", postLogout)
 
 	e.GET("/channel/:channel_id", getChannel)
+	e.POST("/channel/:channel_id/invite", postInvite)
+	e.POST("/channel/:channel_id/kick", postKick)
+	e.POST("/channel/:channel_id/leave", postLeave)
+	e.GET("/channel/:channel_id/edit", getEditChannel)
+	e.POST("/channel/:channel_id/edit", postEditChannel)
+	e.POST("/channel/:channel_id/archive", postArchiveChannel)
+	e.POST("/channel/:channel_id/delete", postDeleteChannel)
 	e.GET("/message", getMessage)
-	e.POST("/message", postMessage)
+	e.POST("/message", postMessage, rateLimit("message"))
+	e.PUT("/message/:message_id", putMessage)
+	e.DELETE("/message/:message_id", deleteMessage)
+	e.GET("/message/:message_id/edits", getMessageEdits)
+	e.GET("/thread/:message_id", getThread)
+	e.POST("/message/:message_id/reactions", postReaction)
+	e.DELETE("/message/:message_id/reactions", deleteReaction)
+	e.GET("/reactions", getReactions)
 	e.GET("/fetch", fetchUnread)
+	e.GET("/stream", getStream)
 	e.GET("/history/:channel_id", getHistory)
+	e.GET("/search", getSearch)
 
 	e.GET("/profile/:user_name", getProfile)
+	e.POST("/dm", postDirect)
 	e.POST("/profile", postProfile)
+	e.POST("/sessions/revoke", postRevokeSession)
+	e.POST("/sessions/revoke_all", postRevokeAllSessions)
 
 	e.GET("add_channel", getAddChannel)
 	e.POST("add_channel", postAddChannel)
 	e.GET("/icons/:file_name", getIcon)
+	e.HEAD("/icons/:file_name", getIcon)
+
+	routeAPI(e)
 
-	e.Start(":5000")
+	go rebuildSearchIndex()
+	go expireSessions()
+	go pruneReactionLog()
+
+	if err := serve(e); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Uploaded avatars must decode as JPEG, PNG or GIF, whatever their file name says,
+// and are named with the extension of their actual format. Metadata that may carry
+// personal data (EXIF, XMP, IPTC, comments, text chunks, GIF application
+// extensions) is removed without re-encoding; a JPEG whose EXIF orientation is not
+// the default is rotated and re-encoded instead, since removing its EXIF would turn it.
+//
+// Square thumbnails of thumbnailSizes are stored next to each avatar, and served
+// by /icons/:file_name?size=N. They are made on first request for older avatars,
+// with their EXIF orientation applied.
+
+const (
+	avatarMaxDimension = 4096
+	thumbnailQuality   = 85
+	rotatedJPEGQuality = 92
+)
+
+var thumbnailSizes = []int{32, 64, 128}
+
+var errInvalidImage = echo.NewHTTPError(http.StatusBadRequest, "invalid image")
+
+// processAvatar validates an uploaded image. It returns the data to store, the
+// decoded image turned upright and the extension of its format.
+// The data is stored as uploaded, unless strip is set: then metadata is removed and
+// JPEG images with an EXIF orientation are rotated and encoded again.
+func processAvatar(data []byte, strip bool) ([]byte, image.Image, string, error) {
+	conf, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, "", errInvalidImage
+	}
+	if conf.Width <= 0 || conf.Height <= 0 ||
+		conf.Width > avatarMaxDimension || conf.Height > avatarMaxDimension {
+		return nil, nil, "", errInvalidImage
+	}
+
+	switch format {
+	case "jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, "", errInvalidImage
+		}
+		o := jpegOrientation(data)
+		if o > 1 && o <= 8 {
+			img = orientImage(img, o)
+		}
+		if !strip {
+			return data, img, ".jpg", nil
+		}
+		if o > 1 && o <= 8 {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: rotatedJPEGQuality}); err != nil {
+				return nil, nil, "", err
+			}
+			return buf.Bytes(), img, ".jpg", nil
+		}
+		stripped, err := stripJPEGMetadata(data)
+		if err != nil {
+			return nil, nil, "", errInvalidImage
+		}
+		return stripped, img, ".jpg", nil
+
+	case "png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, "", errInvalidImage
+		}
+		if !strip {
+			return data, img, ".png", nil
+		}
+		stripped, err := stripPNGMetadata(data)
+		if err != nil {
+			return nil, nil, "", errInvalidImage
+		}
+		return stripped, img, ".png", nil
+
+	case "gif":
+		// Decode every frame to validate the whole file.
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil || len(g.Image) == 0 {
+			return nil, nil, "", errInvalidImage
+		}
+		if !strip {
+			return data, g.Image[0], ".gif", nil
+		}
+		stripped, err := stripGIFMetadata(data)
+		if err != nil {
+			return nil, nil, "", errInvalidImage
+		}
+		return stripped, g.Image[0], ".gif", nil
+	}
+	return nil, nil, "", errInvalidImage
+}
+
+// JPEG segments that are dropped: APP1 (EXIF, XMP), APP13 (IPTC) and comments.
+var jpegDroppedMarkers = map[byte]bool{0xe1: true, 0xed: true, 0xfe: true}
+
+// jpegSegments calls fn with the marker and payload of each segment before the scan.
+// It returns the offset of the start of scan segment.
+func jpegSegments(data []byte, fn func(marker byte, start, end int)) (int, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, errInvalidImage
+	}
+	i := 2
+	for {
+		if i+4 > len(data) || data[i] != 0xff {
+			return 0, errInvalidImage
+		}
+		marker := data[i+1]
+		if marker == 0xff { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xda {
+			return i, nil
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return 0, errInvalidImage
+		}
+		fn(marker, i, i+2+n)
+		i += 2 + n
+	}
+}
+
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xff, 0xd8)
+	sos, err := jpegSegments(data, func(marker byte, start, end int) {
+		if !jpegDroppedMarkers[marker] {
+			out = append(out, data[start:end]...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(out, data[sos:]...), nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 0 if it has none.
+func jpegOrientation(data []byte) int {
+	orientation := 0
+	jpegSegments(data, func(marker byte, start, end int) {
+		payload := data[start+4 : end]
+		if marker != 0xe1 || orientation != 0 || !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return
+		}
+		orientation = exifOrientation(payload[6:])
+	})
+	return orientation
+}
+
+// exifOrientation reads tag 0x0112 of IFD0 of a TIFF structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// orientImage applies an EXIF orientation (2 to 8) to the image.
+func orientImage(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// PNG chunks that are dropped: EXIF, text and modification time.
+var pngDroppedChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errInvalidImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, signature...)
+	for i := len(signature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errInvalidImage
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n
+		if end > len(data) {
+			return nil, errInvalidImage
+		}
+		if !pngDroppedChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// gifSubBlocks returns the end of the data sub-blocks starting at i.
+func gifSubBlocks(data []byte, i int) (int, error) {
+	for {
+		if i >= len(data) {
+			return 0, errInvalidImage
+		}
+		n := int(data[i])
+		i++
+		if n == 0 {
+			return i, nil
+		}
+		i += n
+	}
+}
+
+// stripGIFMetadata drops the comment extensions, the application extensions (XMP...)
+// but NETSCAPE2.0, which makes animations loop, and anything after the trailer.
+func stripGIFMetadata(data []byte) ([]byte, error) {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return nil, errInvalidImage
+	}
+	i := 13
+	if data[10]&0x80 != 0 { // global color table
+		i += 3 << (data[10]&7 + 1)
+	}
+	if i > len(data) {
+		return nil, errInvalidImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:i]...)
+	for i < len(data) {
+		start := i
+		switch data[i] {
+		case 0x21: // extension
+			if i+2 > len(data) {
+				return nil, errInvalidImage
+			}
+			end, err := gifSubBlocks(data, i+2)
+			if err != nil {
+				return nil, err
+			}
+			label := data[i+1]
+			if label != 0xfe && (label != 0xff || bytes.HasPrefix(data[i+2:end], []byte("\x0bNETSCAPE2.0"))) {
+				out = append(out, data[start:end]...)
+			}
+			i = end
+		case 0x2c: // image descriptor
+			if i+11 > len(data) {
+				return nil, errInvalidImage
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 { // local color table
+				i += 3 << (flags&7 + 1)
+			}
+			end, err := gifSubBlocks(data, i+1) // after the LZW minimum code size
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, data[start:end]...)
+			i = end
+		case 0x3b: // trailer
+			return append(out, 0x3b), nil
+		default:
+			return nil, errInvalidImage
+		}
+	}
+	return nil, errInvalidImage
+}
+
+// thumbnailName returns the name of the thumbnail of an avatar: JPEG for JPEG
+// avatars and PNG for the others.
+func thumbnailName(name string, size int) string {
+	base, ext := name, ".png"
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		base = name[:i]
+		if e := name[i:]; e == ".jpg" || e == ".jpeg" {
+			ext = ".jpg"
+		}
+	}
+	return base + "_" + strconv.Itoa(size) + ext
+}
+
+func validThumbnailSize(size int) bool {
+	for _, s := range thumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// makeThumbnail crops the center square of the image and scales it to size,
+// averaging the source pixels covered by each thumbnail pixel.
+func makeThumbnail(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2))
+	src := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(src, src.Bounds(), img, crop.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		y0, y1 := dy*side/size, (dy+1)*side/size
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < size; dx++ {
+			x0, x1 := dx*side/size, (dx+1)*side/size
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint32
+			for y := y0; y < y1; y++ {
+				p := src.Pix[y*src.Stride+x0*4 : y*src.Stride+x1*4]
+				for j := 0; j < len(p); j += 4 {
+					r += uint32(p[j])
+					g += uint32(p[j+1])
+					bl += uint32(p[j+2])
+					a += uint32(p[j+3])
+					n++
+				}
+			}
+			o := dy*dst.Stride + dx*4
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(bl / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func encodeThumbnail(img image.Image, name string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if strings.HasSuffix(name, ".jpg") {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// storeThumbnails makes and stores the thumbnails of an avatar.
+func storeThumbnails(ctx context.Context, name string, img image.Image) error {
+	for _, size := range thumbnailSizes {
+		thumb := thumbnailName(name, size)
+		data, err := encodeThumbnail(makeThumbnail(img, size), thumb)
+		if err != nil {
+			return err
+		}
+		if err := imageStore.Put(ctx, thumb, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadThumbnail returns the thumbnail of the avatar, making it if needed.
+func loadThumbnail(ctx context.Context, name string, size int) ([]byte, error) {
+	thumb := thumbnailName(name, size)
+	data, err := imageStore.Get(ctx, thumb)
+	if err != errImageNotFound {
+		return data, err
+	}
+
+	orig, err := imageStore.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	img, format, err := image.Decode(bytes.NewReader(orig))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image %s: %v", name, err)
+	}
+	// Avatars uploaded before they were rotated on upload still have their orientation.
+	if o := jpegOrientation(orig); format == "jpeg" && o > 1 && o <= 8 {
+		img = orientImage(img, o)
+	}
+	data, err = encodeThumbnail(makeThumbnail(img, size), thumb)
+	if err != nil {
+		return nil, err
+	}
+	if err := imageStore.Put(ctx, thumb, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// sniffImageType returns the MIME type of image data, or "" if it is not an image.
+func sniffImageType(data []byte) string {
+	mime := http.DetectContentType(data)
+	if !strings.HasPrefix(mime, "image/") {
+		return ""
+	}
+	return mime
+}
+
+const iconCacheControl = "public, max-age=31536000, immutable"
+
+// iconETag is a strong ETag made from the name, since the content of a name never changes.
+func iconETag(name string, size int) string {
+	if size != 0 {
+		return `"` + name + "-" + strconv.Itoa(size) + `"`
+	}
+	return `"` + name + `"`
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since without it, for an icon
+// that exists (RFC 7232, section 6).
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(ims)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// tiffWithEntries makes a TIFF header and an IFD0 of (tag, short value) entries
+// at ifdOffset. count overrides the number of entries written in the IFD if not 0.
+func tiffWithEntries(order binary.ByteOrder, ifdOffset uint32, count uint16, entries [][2]uint16) []byte {
+	b := make([]byte, 8)
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], ifdOffset)
+	if count == 0 {
+		count = uint16(len(entries))
+	}
+	ifd := make([]byte, 2+12*len(entries))
+	order.PutUint16(ifd, count)
+	for i, e := range entries {
+		entry := ifd[2+12*i:]
+		order.PutUint16(entry, e[0])
+		order.PutUint16(entry[2:], 3) // SHORT
+		order.PutUint32(entry[4:], 1)
+		order.PutUint16(entry[8:], e[1])
+	}
+	return append(b, ifd...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"little endian", tiffWithEntries(le, 8, 0, [][2]uint16{{0x0100, 16}, {0x0112, 6}}), 6},
+		{"big endian", tiffWithEntries(be, 8, 0, [][2]uint16{{0x0112, 3}}), 3},
+		{"no orientation", tiffWithEntries(le, 8, 0, [][2]uint16{{0x0100, 16}}), 0},
+		{"too short", []byte("II*\x00"), 0},
+		{"bad byte order", append([]byte("XX"), tiffWithEntries(le, 8, 0, [][2]uint16{{0x0112, 6}})[2:]...), 0},
+		{"IFD offset past the end", tiffWithEntries(le, 4096, 0, [][2]uint16{{0x0112, 6}}), 0},
+		{"IFD offset in the header", tiffWithEntries(le, 2, 0, [][2]uint16{{0x0112, 6}}), 0},
+		{"truncated entries", tiffWithEntries(be, 8, 3, [][2]uint16{{0x0100, 16}}), 0},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation(tt.tiff); got != tt.want {
+			t.Errorf("%s: exifOrientation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// jpegSegment makes a segment of the marker with the payload.
+func jpegSegment(marker byte, payload string) []byte {
+	b := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(2+len(payload)))
+	return append(b, payload...)
+}
+
+// withSegments inserts segments right after the SOI of a JPEG.
+func withSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, data[2:]...)
+}
+
+func exifSegment(orientation uint16) []byte {
+	return jpegSegment(0xe1, "Exif\x00\x00"+string(tiffWithEntries(binary.BigEndian, 8, 0, [][2]uint16{{0x0112, orientation}})))
+}
+
+// halvesImage is w x h, red in its top half and blue in its bottom half.
+func halvesImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if y >= h/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestJPEGSegments(t *testing.T) {
+	base := encodeJPEG(t, halvesImage(8, 8))
+	truncated := append([]byte{0xff, 0xd8}, jpegSegment(0xe1, "Exif\x00\x00")...)
+	binary.BigEndian.PutUint16(truncated[4:], 0x100)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		valid       bool
+		orientation int
+	}{
+		{"plain", base, true, 0},
+		{"exif and comment", withSegments(base, exifSegment(3), jpegSegment(0xfe, "secret")), true, 3},
+		{"no SOI", base[2:], false, 0},
+		{"truncated segment", append(truncated, base[2:]...), false, 0},
+		{"segment shorter than its length field", withSegments(base, []byte{0xff, 0xe1, 0, 1}), false, 0},
+		{"no start of scan", base[:20], false, 0},
+		{"bad IFD offset", withSegments(base, jpegSegment(0xe1, "Exif\x00\x00"+
+			string(tiffWithEntries(binary.BigEndian, 1000, 0, [][2]uint16{{0x0112, 6}})))), true, 0},
+	}
+	for _, tt := range tests {
+		if got := jpegOrientation(tt.data); got != tt.orientation {
+			t.Errorf("%s: jpegOrientation = %d, want %d", tt.name, got, tt.orientation)
+		}
+		stripped, err := stripJPEGMetadata(tt.data)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: stripJPEGMetadata succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: stripJPEGMetadata: %v", tt.name, err)
+			continue
+		}
+		if bytes.Contains(stripped, []byte("Exif")) || bytes.Contains(stripped, []byte("secret")) {
+			t.Errorf("%s: metadata left after stripJPEGMetadata", tt.name)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("%s: stripped JPEG does not decode: %v", tt.name, err)
+		}
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// 2x3 image of the pixels
+	//   a b
+	//   c d
+	//   e f
+	src := image.NewGray(image.Rect(0, 0, 2, 3))
+	copy(src.Pix, "abcdef")
+
+	tests := []struct {
+		orientation int
+		want        []string
+	}{
+		{1, []string{"ab", "cd", "ef"}},
+		{2, []string{"ba", "dc", "fe"}},
+		{3, []string{"fe", "dc", "ba"}},
+		{4, []string{"ef", "cd", "ab"}},
+		{5, []string{"ace", "bdf"}},
+		{6, []string{"eca", "fdb"}},
+		{7, []string{"fdb", "eca"}},
+		{8, []string{"bdf", "ace"}},
+	}
+	for _, tt := range tests {
+		dst := orientImage(src, tt.orientation)
+		b := dst.Bounds()
+		var got []string
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			var row []byte
+			for x := b.Min.X; x < b.Max.X; x++ {
+				row = append(row, color.GrayModel.Convert(dst.At(x, y)).(color.Gray).Y)
+			}
+			got = append(got, string(row))
+		}
+		if strings.Join(got, "/") != strings.Join(tt.want, "/") {
+			t.Errorf("orientation %d: got %v, want %v", tt.orientation, got, tt.want)
+		}
+	}
+}
+
+func TestProcessAvatarOrientation(t *testing.T) {
+	base := encodeJPEG(t, halvesImage(16, 32))
+	for o := 1; o <= 8; o++ {
+		upload := withSegments(base, exifSegment(uint16(o)))
+		w, h := 16, 32
+		if o >= 5 {
+			w, h = 32, 16
+		}
+
+		data, img, ext, err := processAvatar(upload, false)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", o, err)
+		}
+		if b := img.Bounds(); ext != ".jpg" || b.Dx() != w || b.Dy() != h {
+			t.Errorf("orientation %d: %s image of %dx%d, want .jpg of %dx%d", o, ext, b.Dx(), b.Dy(), w, h)
+		}
+		if !bytes.Equal(data, upload) {
+			t.Errorf("orientation %d: data changed without strip", o)
+		}
+
+		data, img, ext, err = processAvatar(upload, true)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", o, err)
+		}
+		if b := img.Bounds(); ext != ".jpg" || b.Dx() != w || b.Dy() != h {
+			t.Errorf("orientation %d: %s image of %dx%d, want .jpg of %dx%d", o, ext, b.Dx(), b.Dy(), w, h)
+		}
+		if jpegOrientation(data) != 0 {
+			t.Errorf("orientation %d: stored data still has an orientation", o)
+		}
+	}
+}
+
+// gifExtension makes an extension block with one data sub-block.
+func gifExtension(label byte, data string) []byte {
+	return append([]byte{0x21, label, byte(len(data))}, append([]byte(data), 0)...)
+}
+
+func TestStripGIFMetadata(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{LoopCount: 0}
+	for i := 0; i < 2; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	base := buf.Bytes()
+	if !bytes.Contains(base, []byte("NETSCAPE2.0")) {
+		t.Fatal("no NETSCAPE2.0 extension in the fixture")
+	}
+
+	trailer := len(base) - 1
+	var data []byte
+	data = append(data, base[:trailer]...)
+	data = append(data, gifExtension(0xfe, "secret comment")...)
+	data = append(data, gifExtension(0xff, "XMP DataXMPsecret xmp")...)
+	data = append(data, 0x3b)
+	data = append(data, "secret trailing data"...)
+
+	if kept, _, _, err := processAvatar(data, false); err != nil || !bytes.Equal(kept, data) {
+		t.Errorf("processAvatar without strip changed the data: %v", err)
+	}
+	stripped, img, ext, err := processAvatar(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext != ".gif" || img.Bounds().Dx() != 4 {
+		t.Errorf("processAvatar = %s image of %v", ext, img.Bounds())
+	}
+	if bytes.Contains(stripped, []byte("secret")) {
+		t.Errorf("metadata left after stripping: %q", stripped)
+	}
+	if !bytes.Contains(stripped, []byte("NETSCAPE2.0")) {
+		t.Errorf("NETSCAPE2.0 extension was removed")
+	}
+	if !bytes.Equal(stripped, base) {
+		t.Errorf("stripped GIF differs from the original")
+	}
+	if out, err := gif.DecodeAll(bytes.NewReader(stripped)); err != nil || len(out.Image) != 2 {
+		t.Errorf("stripped GIF does not decode to 2 frames: %v", err)
+	}
+
+	for _, n := range []int{5, 13, 20, trailer} {
+		if _, err := stripGIFMetadata(base[:n]); err == nil {
+			t.Errorf("stripGIFMetadata of %d of %d bytes succeeded", n, len(base))
+		}
+	}
+}
+
+func TestLoadThumbnailOrientation(t *testing.T) {
+	defer func(s ImageStore) { imageStore = s }(imageStore)
+	imageStore = &fsImageStore{Dir: t.TempDir()}
+
+	// An avatar stored before avatars were rotated on upload: turned a quarter
+	// clockwise for display, the top half (red) is on the right.
+	data := withSegments(encodeJPEG(t, halvesImage(16, 32)), exifSegment(6))
+	if err := imageStore.Put(context.Background(), "old.jpg", data); err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := loadThumbnail(context.Background(), "old.jpg", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, right := color.RGBAModel.Convert(img.At(4, 16)).(color.RGBA), color.RGBAModel.Convert(img.At(28, 16)).(color.RGBA)
+	if left.B < 128 || left.R > 128 || right.R < 128 || right.B > 128 {
+		t.Errorf("thumbnail is not oriented: left %v, right %v", left, right)
+	}
+	if _, err := imageStore.Get(context.Background(), thumbnailName("old.jpg", 32)); err != nil {
+		t.Errorf("thumbnail was not stored: %v", err)
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, halvesImage(4, 4)); err != nil {
+		t.Fatal(err)
+	}
+	base := buf.Bytes()
+	// a tEXt chunk after IHDR (8 + 25 bytes); the CRC is not checked here
+	text := append([]byte{0, 0, 0, 6}, "tEXtsecret\x00\x00\x00\x00"...)
+	data := append(append(append([]byte{}, base[:33]...), text...), base[33:]...)
+
+	stripped, err := stripPNGMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, base) {
+		t.Errorf("tEXt chunk was not removed")
+	}
+	if _, err := stripPNGMetadata(data[:40]); err == nil {
+		t.Errorf("stripPNGMetadata of a truncated chunk succeeded")
+	}
+}
+
+func TestGetIconConditional(t *testing.T) {
+	defer func(s ImageStore) { imageStore = s }(imageStore)
+	imageStore = &fsImageStore{Dir: t.TempDir()}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, halvesImage(4, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := imageStore.Put(context.Background(), "a.png", buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime, err := imageStore.ModTime(context.Background(), "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := modTime.UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		file   string
+		header map[string]string
+		status int
+	}{
+		{"plain", "a.png", nil, http.StatusOK},
+		{"matching etag", "a.png", map[string]string{"If-None-Match": `"a.png"`}, http.StatusNotModified},
+		{"other etag", "a.png", map[string]string{"If-None-Match": `"b.png"`}, http.StatusOK},
+		{"any etag", "a.png", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"modified since", "a.png", map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusOK},
+		{"not modified since", "a.png", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"other etag and not modified since", "a.png",
+			map[string]string{"If-None-Match": `"b.png"`, "If-Modified-Since": lastModified}, http.StatusOK},
+		{"thumbnail not modified since", "a.png?size=32", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"missing with any etag", "b.png", map[string]string{"If-None-Match": "*"}, http.StatusNotFound},
+		{"missing with if-modified-since", "b.png", map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusNotFound},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/icons/"+tt.file, nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("file_name")
+		c.SetParamValues(strings.SplitN(tt.file, "?", 2)[0])
+
+		err := getIcon(c)
+		status := rec.Code
+		if err != nil {
+			he, ok := err.(*echo.HTTPError)
+			if !ok {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			status = he.Code
+		}
+		if status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+		if status == http.StatusNotFound && rec.Header().Get("ETag") != "" {
+			t.Errorf("%s: ETag sent with 404", tt.name)
+		}
+		if status != http.StatusNotFound && rec.Header().Get("Last-Modified") != lastModified {
+			t.Errorf("%s: Last-Modified %q, want %q", tt.name, rec.Header().Get("Last-Modified"), lastModified)
+		}
+	}
+}
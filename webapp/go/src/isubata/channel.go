@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// Channels can be renamed, archived and deleted by their owner and by admins.
+// Archived channels are read-only: nothing can be posted, edited or reacted to.
+
+var errChannelArchived = echo.NewHTTPError(http.StatusForbidden, "channel is archived")
+
+// checkChannelWritable returns errChannelArchived if the channel is archived.
+func checkChannelWritable(ctx context.Context, chID int64) error {
+	var archived bool
+	err := db.GetContext(ctx, &archived, "SELECT is_archived FROM channel WHERE id = ?", chID)
+	if err == sql.ErrNoRows {
+		return echo.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if archived {
+		return errChannelArchived
+	}
+	return nil
+}
+
+// manageableChannel returns the channel if the user can see it and is its owner or an admin.
+// Direct messages cannot be managed.
+func manageableChannel(ctx context.Context, user *User, chID int64) (*ChannelInfo, error) {
+	if err := checkChannelAccess(ctx, user.ID, chID); err != nil {
+		return nil, err
+	}
+	ch, err := getChannelInfo(ctx, chID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		return nil, echo.ErrNotFound
+	}
+	if ch.IsDirect {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "cannot manage a direct message")
+	}
+	if ch.OwnerID != user.ID && !user.IsAdmin {
+		return nil, echo.ErrForbidden
+	}
+	return ch, nil
+}
+
+func updateChannel(ctx context.Context, chID int64, name, desc string) error {
+	_, err := db.ExecContext(ctx, "UPDATE channel SET name = ?, description = ?, updated_at = NOW() WHERE id = ?",
+		name, desc, chID)
+	if err != nil {
+		return err
+	}
+	hub.Publish(Event{Type: EventChannel, ChannelID: chID})
+	return nil
+}
+
+func archiveChannel(ctx context.Context, chID int64, archived bool) error {
+	_, err := db.ExecContext(ctx, "UPDATE channel SET is_archived = ?, updated_at = NOW() WHERE id = ?",
+		archived, chID)
+	if err != nil {
+		return err
+	}
+	hub.Publish(Event{Type: EventChannel, ChannelID: chID})
+	return nil
+}
+
+// deleteChannel deletes the channel with its messages and everything attached to them.
+func deleteChannel(ctx context.Context, chID int64) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		"DELETE t FROM thread_haveread t JOIN message m ON m.id = t.parent_id WHERE m.channel_id = ?",
+		"DELETE r FROM reaction r JOIN message m ON m.id = r.message_id WHERE m.channel_id = ?",
+		"DELETE e FROM message_edit e JOIN message m ON m.id = e.message_id WHERE m.channel_id = ?",
+		"DELETE FROM reaction_log WHERE channel_id = ?",
+		"DELETE FROM mention WHERE channel_id = ?",
+		"DELETE FROM haveread WHERE channel_id = ?",
+		"DELETE FROM channel_counter WHERE channel_id = ?",
+		"DELETE FROM message WHERE channel_id = ?",
+		"DELETE FROM channel_member WHERE channel_id = ?",
+		"DELETE FROM channel WHERE id = ?",
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q, chID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	hub.Publish(Event{Type: EventChannel, ChannelID: chID})
+	return nil
+}
+
+func getEditChannel(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	ch, err := manageableChannel(c.Request().Context(), self, chID)
+	if err != nil {
+		return err
+	}
+
+	channels, err := queryChannelInfos(c.Request().Context(), self.ID)
+	if err != nil {
+		return err
+	}
+	directs, err := queryDirectChannels(c.Request().Context(), self.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "edit_channel", map[string]interface{}{
+		"ChannelID": ch.ID,
+		"Channels":  channels,
+		"Directs":   directs,
+		"User":      self,
+		"Channel":   ch,
+	})
+}
+
+func postEditChannel(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	name := c.FormValue("name")
+	desc := c.FormValue("description")
+	if name == "" || desc == "" {
+		return ErrBadReqeust
+	}
+	ch, err := manageableChannel(c.Request().Context(), self, chID)
+	if err != nil {
+		return err
+	}
+	if err := updateChannel(c.Request().Context(), ch.ID, name, desc); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", ch.ID))
+}
+
+// postArchiveChannel archives the channel, or unarchives it with archived=0.
+func postArchiveChannel(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	ch, err := manageableChannel(c.Request().Context(), self, chID)
+	if err != nil {
+		return err
+	}
+	if err := archiveChannel(c.Request().Context(), ch.ID, c.FormValue("archived") != "0"); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", ch.ID))
+}
+
+func postDeleteChannel(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	ch, err := manageableChannel(c.Request().Context(), self, chID)
+	if err != nil {
+		return err
+	}
+	if err := deleteChannel(c.Request().Context(), ch.ID); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
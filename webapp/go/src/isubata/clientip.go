@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"isubata/config"
+)
+
+// The client address is the peer of the connection, unless the peer is one of the
+// trusted proxies: then it is the last address of X-Forwarded-For not added by a
+// trusted proxy, or X-Real-IP. Anyone else could put anything in those headers.
+
+var trustedProxies []*net.IPNet
+
+func initTrustedProxies() {
+	trustedProxies = nil
+	for _, s := range cfg.TrustedProxies {
+		n, err := config.ParseIPNet(s)
+		if err != nil {
+			log.Fatal("trusted proxies: ", err)
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+}
+
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the address of the client of the request.
+func clientIP(r *http.Request) string {
+	ip := remoteHost(r)
+	if !trustedProxy(ip) {
+		return ip
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if !trustedProxy(hop) {
+				return hop
+			}
+			ip = hop
+		}
+		return ip
+	}
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+		return xri
+	}
+	return ip
+}
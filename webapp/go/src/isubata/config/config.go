@@ -0,0 +1,318 @@
+// Package config loads the settings of the isubata webapp.
+//
+// Settings are taken, in increasing order of precedence, from the defaults, a JSON
+// file given by -config or ISUBATA_CONFIG, environment variables and command-line
+// flags. Each flag has an environment variable named after it: -db-host is
+// ISUBATA_DB_HOST, -session-secrets is ISUBATA_SESSION_SECRETS and so on.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Listen    string `json:"listen"`
+	Templates string `json:"templates"`
+	PublicDir string `json:"public_dir"`
+	// ShutdownTimeout is how long in-flight requests may run after SIGTERM.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// DrainDelay is how long /readyz fails before the server stops accepting
+	// connections, for load balancers to notice.
+	DrainDelay Duration `json:"drain_delay"`
+	// LogLevel is debug, info, warn or error. Queries are logged at debug.
+	LogLevel string `json:"log_level"`
+
+	DB DBConfig `json:"db"`
+
+	SessionStore   string   `json:"session_store"`
+	SessionSecrets []string `json:"session_secrets"`
+
+	AvatarMaxBytes int64 `json:"avatar_max_bytes"`
+	// StripAvatarMetadata removes EXIF and other metadata from uploaded avatars.
+	// Avatars are stored as uploaded by default, as the benchmark checks.
+	StripAvatarMetadata bool   `json:"strip_avatar_metadata"`
+	RateLimits          string `json:"rate_limits"`
+	// TrustedProxies are the addresses (IPs or CIDRs) whose X-Forwarded-For and
+	// X-Real-IP are believed. Other clients are known by their own address.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// ImageStore is where avatars are kept: mysql, fs (in ImageDir) or s3.
+	ImageStore string   `json:"image_store"`
+	ImageDir   string   `json:"image_dir"`
+	S3         S3Config `json:"s3"`
+
+	// Args are the command-line arguments after the flags.
+	Args []string `json:"-"`
+}
+
+// S3Config is an S3-compatible bucket, addressed path-style under Endpoint.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+type DBConfig struct {
+	Host            string   `json:"host"`
+	Port            int      `json:"port"`
+	User            string   `json:"user"`
+	Password        string   `json:"password"`
+	Name            string   `json:"name"`
+	MaxOpenConns    int      `json:"max_open_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+	// ConnectTimeout is how long to wait for the database at startup.
+	ConnectTimeout Duration `json:"connect_timeout"`
+}
+
+// DSN returns the data source name for go-sql-driver/mysql.
+func (c DBConfig) DSN() string {
+	userinfo := c.User
+	if c.Password != "" {
+		userinfo += ":" + c.Password
+	}
+	return fmt.Sprintf("%s@tcp(%s:%d)/%s?parseTime=true&loc=Local&charset=utf8mb4",
+		userinfo, c.Host, c.Port, c.Name)
+}
+
+// Default returns the settings used when nothing else is given.
+func Default() *Config {
+	return &Config{
+		Listen:          ":5000",
+		ShutdownTimeout: Duration(10 * time.Second),
+		DrainDelay:      Duration(5 * time.Second),
+		LogLevel:        "info",
+		Templates:       "views/*.html",
+		PublicDir:       "../public",
+		DB: DBConfig{
+			Host:            "127.0.0.1",
+			Port:            3306,
+			User:            "root",
+			Name:            "isubata",
+			MaxOpenConns:    20,
+			ConnMaxLifetime: Duration(5 * time.Minute),
+			ConnectTimeout:  Duration(time.Minute),
+		},
+		SessionStore:   "mysql",
+		SessionSecrets: []string{"secretonymoris"},
+		AvatarMaxBytes: 1 * 1024 * 1024,
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+		ImageStore:     "mysql",
+		ImageDir:       "../images",
+		S3:             S3Config{Region: "us-east-1"},
+	}
+}
+
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "how long to drain requests on SIGTERM")
+	fs.Var(&c.DrainDelay, "drain-delay", "how long to fail /readyz before closing the listener on SIGTERM")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.Templates, "templates", c.Templates, "glob of the HTML templates")
+	fs.StringVar(&c.PublicDir, "public-dir", c.PublicDir, "directory of the static files")
+	fs.StringVar(&c.DB.Host, "db-host", c.DB.Host, "MySQL host")
+	fs.IntVar(&c.DB.Port, "db-port", c.DB.Port, "MySQL port")
+	fs.StringVar(&c.DB.User, "db-user", c.DB.User, "MySQL user")
+	fs.StringVar(&c.DB.Password, "db-password", c.DB.Password, "MySQL password")
+	fs.StringVar(&c.DB.Name, "db-name", c.DB.Name, "MySQL database")
+	fs.IntVar(&c.DB.MaxOpenConns, "db-max-open-conns", c.DB.MaxOpenConns, "maximum number of open connections")
+	fs.Var(&c.DB.ConnMaxLifetime, "db-conn-max-lifetime", "maximum lifetime of a connection")
+	fs.Var(&c.DB.ConnectTimeout, "db-connect-timeout", "how long to wait for MySQL at startup")
+	fs.StringVar(&c.SessionStore, "session-store", c.SessionStore, "session backend: mysql or memory")
+	fs.Var((*stringList)(&c.SessionSecrets), "session-secrets", "comma-separated session signing keys, newest first")
+	fs.Int64Var(&c.AvatarMaxBytes, "avatar-max-bytes", c.AvatarMaxBytes, "maximum size of an avatar image")
+	fs.BoolVar(&c.StripAvatarMetadata, "strip-avatar-metadata", c.StripAvatarMetadata, "remove metadata from uploaded avatars")
+	fs.StringVar(&c.RateLimits, "rate-limits", c.RateLimits, "rate limits to enable, all off by default, e.g. login=20/m:20,message=5/s:20")
+	fs.Var((*stringList)(&c.TrustedProxies), "trusted-proxies", "comma-separated IPs or CIDRs of the reverse proxies")
+	fs.StringVar(&c.ImageStore, "image-store", c.ImageStore, "avatar store: mysql, fs or s3")
+	fs.StringVar(&c.ImageDir, "image-dir", c.ImageDir, "directory of the fs image store")
+	fs.StringVar(&c.S3.Endpoint, "s3-endpoint", c.S3.Endpoint, "URL of the S3-compatible service")
+	fs.StringVar(&c.S3.Region, "s3-region", c.S3.Region, "S3 region")
+	fs.StringVar(&c.S3.Bucket, "s3-bucket", c.S3.Bucket, "S3 bucket of the images")
+	fs.StringVar(&c.S3.AccessKey, "s3-access-key", c.S3.AccessKey, "S3 access key ID")
+	fs.StringVar(&c.S3.SecretKey, "s3-secret-key", c.S3.SecretKey, "S3 secret access key")
+	return fs
+}
+
+func envName(flagName string) string {
+	return "ISUBATA_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// Load reads the settings for the command line args (without the program name).
+func Load(name string, args []string) (*Config, error) {
+	// Parse the flags first to find the config file, but apply them last.
+	parsed := Default()
+	fs := parsed.flagSet(name)
+	path := fs.String("config", os.Getenv("ISUBATA_CONFIG"), "JSON config file")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c := Default()
+	c.Args = fs.Args()
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	target := c.flagSet(name)
+	var err error
+	target.VisitAll(func(f *flag.Flag) {
+		if v := os.Getenv(envName(f.Name)); v != "" && err == nil {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), e)
+			}
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		if t := target.Lookup(f.Name); t != nil && err == nil {
+			if e := t.Value.Set(f.Value.String()); e != nil {
+				err = fmt.Errorf("-%s: %v", f.Name, e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate reports the first setting that cannot work.
+func (c *Config) Validate() error {
+	switch {
+	case c.Listen == "":
+		return errors.New("listen is empty")
+	case c.Templates == "":
+		return errors.New("templates is empty")
+	case c.DB.Host == "":
+		return errors.New("db host is empty")
+	case c.DB.Port <= 0 || c.DB.Port > 65535:
+		return fmt.Errorf("invalid db port %d", c.DB.Port)
+	case c.DB.User == "":
+		return errors.New("db user is empty")
+	case c.DB.Name == "":
+		return errors.New("db name is empty")
+	case c.DB.MaxOpenConns <= 0:
+		return fmt.Errorf("invalid db max open conns %d", c.DB.MaxOpenConns)
+	case c.LogLevel != "debug" && c.LogLevel != "info" && c.LogLevel != "warn" && c.LogLevel != "error":
+		return fmt.Errorf("unknown log level %q", c.LogLevel)
+	case c.ShutdownTimeout < 0:
+		return errors.New("shutdown timeout must not be negative")
+	case c.DrainDelay < 0:
+		return errors.New("drain delay must not be negative")
+	case c.DB.ConnMaxLifetime < 0:
+		return errors.New("db conn max lifetime must not be negative")
+	case c.DB.ConnectTimeout <= 0:
+		return errors.New("db connect timeout must be positive")
+	case c.SessionStore != "mysql" && c.SessionStore != "memory":
+		return fmt.Errorf("unknown session store %q", c.SessionStore)
+	case len(c.SessionSecrets) == 0:
+		return errors.New("no session secrets")
+	case c.AvatarMaxBytes <= 0:
+		return fmt.Errorf("invalid avatar max bytes %d", c.AvatarMaxBytes)
+	case c.ImageStore == "fs" && c.ImageDir == "":
+		return errors.New("image dir is empty")
+	case c.ImageStore == "s3" && (c.S3.Endpoint == "" || c.S3.Bucket == "" || c.S3.Region == ""):
+		return errors.New("s3 endpoint, region and bucket are required")
+	case c.ImageStore != "mysql" && c.ImageStore != "fs" && c.ImageStore != "s3":
+		return fmt.Errorf("unknown image store %q", c.ImageStore)
+	}
+	for _, p := range c.TrustedProxies {
+		if _, err := ParseIPNet(p); err != nil {
+			return err
+		}
+	}
+	for _, s := range c.SessionSecrets {
+		if s == "" {
+			return errors.New("empty session secret")
+		}
+	}
+	return nil
+}
+
+// Duration is a time.Duration written as "5m" in JSON and flags.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// ParseIPNet parses a CIDR, or an IP as a network of that address only.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// stringList is a comma-separated flag value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
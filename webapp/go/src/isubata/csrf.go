@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// CSRF protection with a double-submit cookie: every request that changes state
+// must send back the token of the csrf cookie, either as the form field csrf_token
+// or as the X-CSRF-Token header.
+//
+// Tokens are bound to the session: a token is a random nonce with its HMAC, keyed
+// by the session secrets, over the nonce and the session ID. A new token is issued
+// on login and logout, when the session ID changes.
+//
+// Pages get the token as .CSRFToken (see Renderer) and in <meta name="csrf-token">
+// for scripts; API clients can get it from GET /api/v1/csrf_token, and get the new
+// one as the X-CSRF-Token header of the response to login and logout.
+
+const (
+	csrfCookieName  = "_csrf"
+	csrfFormField   = "csrf_token"
+	csrfNonceBytes  = 16
+	csrfTokenMaxAge = 86400 * 30
+)
+
+func csrfMAC(secret, nonce, sessID string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(nonce + ":" + sessID))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newCSRFToken(sessID string) string {
+	b := make([]byte, csrfNonceBytes)
+	crand.Read(b)
+	nonce := hex.EncodeToString(b)
+	return nonce + "." + csrfMAC(cfg.SessionSecrets[0], nonce, sessID)
+}
+
+// validCSRFToken reports whether the token was issued for the session, with any of
+// the session secrets.
+func validCSRFToken(token, sessID string) bool {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	nonce, mac := token[:i], token[i+1:]
+	for _, secret := range cfg.SessionSecrets {
+		if hmac.Equal([]byte(mac), []byte(csrfMAC(secret, nonce, sessID))) {
+			return true
+		}
+	}
+	return false
+}
+
+func csrfProtect(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case echo.GET, echo.HEAD, echo.OPTIONS, echo.TRACE:
+			return next(c)
+		}
+
+		var token string
+		if k, err := c.Cookie(csrfCookieName); err == nil {
+			token = k.Value
+		}
+		clientToken := c.Request().Header.Get(echo.HeaderXCSRFToken)
+		if clientToken == "" {
+			clientToken = c.FormValue(csrfFormField)
+		}
+		if !validCSRFToken(token, sessID(c)) || subtle.ConstantTimeCompare([]byte(token), []byte(clientToken)) != 1 {
+			// Global middleware does not go through apiErrorHandler.
+			if strings.HasPrefix(c.Request().URL.Path, "/api/v1/") {
+				return apiErrorResponse(c, http.StatusForbidden, "invalid csrf token")
+			}
+			return echo.NewHTTPError(http.StatusForbidden, "invalid csrf token")
+		}
+		c.Set("csrf", token)
+		return next(c)
+	}
+}
+
+// issueCSRFToken sets a new token for the current session.
+func issueCSRFToken(c echo.Context) string {
+	token := newCSRFToken(sessID(c))
+	c.SetCookie(&http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   csrfTokenMaxAge,
+		HttpOnly: true,
+	})
+	c.Response().Header().Set(echo.HeaderXCSRFToken, token)
+	c.Set("csrf", token)
+	return token
+}
+
+// csrfToken returns the token of the request, issuing one if the request has none
+// valid for its session.
+func csrfToken(c echo.Context) string {
+	if token, ok := c.Get("csrf").(string); ok {
+		return token
+	}
+	if k, err := c.Cookie(csrfCookieName); err == nil && validCSRFToken(k.Value, sessID(c)) {
+		c.Set("csrf", k.Value)
+		return k.Value
+	}
+	return issueCSRFToken(c)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The "isubata-mysql" driver wraps go-sql-driver/mysql to count queries and time
+// them, labelled by the normalized query text. At debug level, it also logs them
+// with the ID of the request of the context they ran with.
+
+const maxQueryLabels = 500
+
+var (
+	dbQueries = NewHistogramVec("isubata_db_query_duration_seconds",
+		"DB query latency by query.", defaultBuckets, "query")
+	dbQueryErrors = NewCounterVec("isubata_db_query_errors_total",
+		"DB queries that failed, by query.", "query")
+)
+
+func init() {
+	sql.Register("isubata-mysql", metricsDriver{mysql.MySQLDriver{}})
+}
+
+var (
+	placeholderList = regexp.MustCompile(`\?(\s*,\s*\?)+`)
+
+	queryLabelsMu sync.Mutex
+	queryLabels   = map[string]bool{}
+)
+
+// queryLabel collapses whitespace and IN (?, ?, ...) lists so that a query has one
+// label whatever its arguments. Past maxQueryLabels labels, new ones are "other".
+func queryLabel(query string) string {
+	label := strings.Join(strings.Fields(query), " ")
+	label = placeholderList.ReplaceAllString(label, "?...")
+
+	queryLabelsMu.Lock()
+	defer queryLabelsMu.Unlock()
+	if queryLabels[label] {
+		return label
+	}
+	if len(queryLabels) >= maxQueryLabels {
+		return "other"
+	}
+	queryLabels[label] = true
+	return label
+}
+
+func observeQuery(ctx context.Context, query string, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	elapsed := time.Since(start)
+	label := queryLabel(query)
+	dbQueries.Observe(elapsed.Seconds(), label)
+	if err != nil && err != driver.ErrBadConn {
+		dbQueryErrors.Inc(label)
+	}
+
+	if logDebugEnabled() {
+		fields := logFields{
+			"request_id": contextRequestID(ctx),
+			"query":      label,
+			"latency_ms": float64(elapsed) / float64(time.Millisecond),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		logAt(levelDebug, "db query", fields)
+	}
+}
+
+type metricsDriver struct {
+	driver.Driver
+}
+
+func (d metricsDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return metricsConn{conn}, nil
+}
+
+type metricsConn struct {
+	driver.Conn
+}
+
+func (c metricsConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return metricsStmt{stmt, query}, nil
+}
+
+// driverValues converts the arguments of the context methods for the
+// mysql driver, which predates them. Like database/sql does for such drivers,
+// it fails once ctx is done.
+func driverValues(ctx context.Context, named []driver.NamedValue) ([]driver.Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	args := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errors.New("isubata-mysql: named arguments are not supported")
+		}
+		args[i] = nv.Value
+	}
+	return args, nil
+}
+
+func (c metricsConn) ExecContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.Execer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	args, err := driverValues(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	res, err := execer.Exec(query, args)
+	observeQuery(ctx, query, start, err)
+	return res, err
+}
+
+func (c metricsConn) QueryContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.Queryer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	args, err := driverValues(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	rows, err := queryer.Query(query, args)
+	observeQuery(ctx, query, start, err)
+	return rows, err
+}
+
+type metricsStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s metricsStmt) ExecContext(ctx context.Context, named []driver.NamedValue) (driver.Result, error) {
+	args, err := driverValues(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	res, err := s.Stmt.Exec(args)
+	observeQuery(ctx, s.query, start, err)
+	return res, err
+}
+
+func (s metricsStmt) QueryContext(ctx context.Context, named []driver.NamedValue) (driver.Rows, error) {
+	args, err := driverValues(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	rows, err := s.Stmt.Query(args)
+	observeQuery(ctx, s.query, start, err)
+	return rows, err
+}
+
+func (s metricsStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
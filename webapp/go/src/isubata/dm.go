@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// Direct messages are private channels flagged is_direct, whose members are the
+// participants. They are left out of the channel list, and the same set of users
+// always gets the same channel: direct_key, the sorted IDs of the members, is unique.
+
+const (
+	directMaxMembers = 8
+)
+
+// DirectChannel is a direct message channel seen by one of its members.
+// Partners are the display names of the other members.
+type DirectChannel struct {
+	ChannelInfo
+	Partners string `json:"partners" db:"partners"`
+}
+
+// queryDirectChannels returns the direct message channels of the user, newest first.
+func queryDirectChannels(ctx context.Context, userID int64) ([]DirectChannel, error) {
+	channels := []DirectChannel{}
+	err := db.SelectContext(ctx, &channels,
+		"SELECT c.*, IFNULL(GROUP_CONCAT(u.display_name ORDER BY u.id SEPARATOR ', '), '') AS partners"+
+			" FROM channel c JOIN channel_member me ON me.channel_id = c.id AND me.user_id = ?"+
+			" LEFT JOIN channel_member o ON o.channel_id = c.id AND o.user_id != me.user_id"+
+			" LEFT JOIN user u ON u.id = o.user_id"+
+			" WHERE c.is_direct = 1 GROUP BY c.id ORDER BY c.id DESC",
+		userID)
+	return channels, err
+}
+
+// openDirect returns the direct message channel between the user and the users names,
+// creating it on first use.
+func openDirect(ctx context.Context, selfID int64, names []string) (int64, error) {
+	if len(names) == 0 {
+		return 0, ErrBadReqeust
+	}
+	query, args, err := sqlx.In("SELECT * FROM user WHERE name IN (?) ORDER BY id", names)
+	if err != nil {
+		return 0, err
+	}
+	users := []User{}
+	if err := db.SelectContext(ctx, &users, query, args...); err != nil {
+		return 0, err
+	}
+
+	if len(users) != len(uniqueStrings(names)) {
+		return 0, echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+
+	ids := []int64{selfID}
+	memberNames := []string{}
+	for _, u := range users {
+		memberNames = append(memberNames, u.Name)
+		if u.ID != selfID {
+			ids = append(ids, u.ID)
+		}
+	}
+	if len(ids) < 2 || len(ids) > directMaxMembers {
+		return 0, ErrBadReqeust
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = strconv.FormatInt(id, 10)
+	}
+	key := strings.Join(keys, ",")
+
+	chID, err := directChannelByKey(ctx, key)
+	if chID != 0 || err != nil {
+		return chID, err
+	}
+
+	self, err := getUser(ctx, selfID)
+	if err != nil {
+		return 0, err
+	}
+	memberNames = append(memberNames, self.Name)
+	sort.Strings(memberNames)
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO channel (name, description, is_private, is_direct, direct_key, owner_id, updated_at, created_at)"+
+			" VALUES (?, '', 1, 1, ?, ?, NOW(), NOW())",
+		strings.Join(uniqueStrings(memberNames), ", "), key, selfID)
+	if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 { // Duplicate entry
+		// opened concurrently by another member
+		tx.Rollback()
+		return directChannelByKey(ctx, key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	chID, err = res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx, "INSERT INTO channel_member (channel_id, user_id, created_at) VALUES (?, ?, NOW())",
+			chID, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	hub.Publish(Event{Type: EventMember, ChannelID: chID})
+	return chID, nil
+}
+
+// directChannelByKey returns the ID of the direct message channel of direct_key,
+// or 0 if there is none.
+func directChannelByKey(ctx context.Context, key string) (int64, error) {
+	var chID int64
+	err := db.GetContext(ctx, &chID, "SELECT id FROM channel WHERE direct_key = ?", key)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return chID, err
+}
+
+func uniqueStrings(ss []string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// postDirect opens the direct message channel with the users listed in names,
+// separated by spaces or commas.
+func postDirect(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	names := strings.FieldsFunc(c.FormValue("names"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '　'
+	})
+	chID, err := openDirect(c.Request().Context(), self.ID, names)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", chID))
+}
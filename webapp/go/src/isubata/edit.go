@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type MessageEdit struct {
+	ID        int64     `json:"-" db:"id"`
+	MessageID int64     `json:"-" db:"message_id"`
+	Content   string    `json:"content" db:"content"`
+	EditedAt  time.Time `json:"-" db:"edited_at"`
+}
+
+// getOwnMessage returns the message if it exists and was posted by the user,
+// and its channel is not archived.
+func getOwnMessage(ctx context.Context, userID, msgID int64) (*Message, error) {
+	m, err := getMessageByID(ctx, msgID)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil || m.DeletedAt.Valid {
+		return nil, echo.ErrNotFound
+	}
+	if err := checkChannelAccess(ctx, userID, m.ChannelID); err != nil {
+		return nil, err
+	}
+	if m.UserID != userID {
+		return nil, echo.ErrForbidden
+	}
+	if err := checkChannelWritable(ctx, m.ChannelID); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// editMessage replaces the content of the message, keeping the previous content
+// in message_edit.
+func editMessage(ctx context.Context, userID, msgID int64, content string) (*Message, error) {
+	m, err := getOwnMessage(ctx, userID, msgID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO message_edit (message_id, content, edited_at) VALUES (?, ?, NOW())",
+		m.ID, m.Content)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE message SET content = ?, edited_at = NOW() WHERE id = ?", content, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	searchIndex.Add(m.ID, content)
+
+	hub.Publish(Event{Type: EventEdit, ChannelID: m.ChannelID, MessageID: m.ID, ParentID: m.ParentID})
+	return getMessageByID(ctx, m.ID)
+}
+
+// removeMessage turns the message into a tombstone.
+func removeMessage(ctx context.Context, userID, msgID int64) error {
+	m, err := getOwnMessage(ctx, userID, msgID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE message SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL", m.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		// deleted concurrently
+		return echo.ErrNotFound
+	}
+	if m.ParentID != 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE message SET reply_count = reply_count - 1 WHERE id = ?", m.ParentID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE thread_haveread SET reply_count = reply_count - 1"+
+			" WHERE parent_id = ? AND message_id >= ?", m.ParentID, m.ID)
+		if err != nil {
+			return err
+		}
+	} else if err := uncountMessage(ctx, tx, m); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE mention SET is_unread = 0 WHERE message_id = ?", m.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	hub.Publish(Event{Type: EventDelete, ChannelID: m.ChannelID, MessageID: m.ID, ParentID: m.ParentID})
+	return nil
+}
+
+func queryMessageEdits(ctx context.Context, msgID int64) ([]map[string]interface{}, error) {
+	edits := []MessageEdit{}
+	err := db.SelectContext(ctx, &edits, "SELECT * FROM message_edit WHERE message_id = ? ORDER BY id", msgID)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]map[string]interface{}, 0, len(edits))
+	for _, e := range edits {
+		r = append(r, map[string]interface{}{
+			"content":   e.Content,
+			"edited_at": e.EditedAt.Format("2006/01/02 15:04:05"),
+		})
+	}
+	return r, nil
+}
+
+func messageIDParam(c echo.Context) (int64, error) {
+	msgID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil || msgID <= 0 {
+		return 0, ErrBadReqeust
+	}
+	return msgID, nil
+}
+
+func putMessage(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+	content := c.FormValue("message")
+	if content == "" {
+		return ErrBadReqeust
+	}
+
+	m, err := editMessage(c.Request().Context(), userID, msgID, content)
+	if err != nil {
+		return err
+	}
+	r, err := jsonifyMessage(c.Request().Context(), *m)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+func deleteMessage(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := removeMessage(c.Request().Context(), userID, msgID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getMessageEdits returns the previous contents of the message, oldest first.
+func getMessageEdits(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	m, err := getMessageByID(c.Request().Context(), msgID)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.DeletedAt.Valid {
+		return echo.ErrNotFound
+	}
+	if err := checkChannelAccess(c.Request().Context(), userID, m.ChannelID); err != nil {
+		return err
+	}
+
+	edits, err := queryMessageEdits(c.Request().Context(), msgID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, edits)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// /healthz tells that the process is up, /readyz that it can serve requests:
+// the database answers and the server is not shutting down.
+//
+// On SIGTERM or SIGINT /readyz starts failing, and after cfg.DrainDelay, for load
+// balancers to stop sending requests, the server stops accepting connections.
+// Long polls and streams waiting on the hub are ended then, and other in-flight
+// requests get cfg.ShutdownTimeout to finish.
+
+const readyzTimeout = 2 * time.Second
+
+var draining int32
+
+func getHealthz(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+func getReadyz(c echo.Context) error {
+	if atomic.LoadInt32(&draining) != 0 {
+		return c.String(http.StatusServiceUnavailable, "shutting down")
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readyzTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return c.String(http.StatusServiceUnavailable, "db: "+err.Error())
+	}
+	return c.String(http.StatusOK, "ok")
+}
+
+// serve runs the server until a signal arrives, then drains it.
+func serve(e *echo.Echo) error {
+	e.Server.Addr = cfg.Listen
+
+	errc := make(chan error, 1)
+	go func() { errc <- e.StartServer(e.Server) }()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		log.Printf("Received %v, shutting down.", sig)
+	}
+
+	atomic.StoreInt32(&draining, 1)
+	time.Sleep(time.Duration(cfg.DrainDelay))
+	hub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := e.Server.Shutdown(ctx); err != nil {
+		return err
+	}
+	log.Printf("Shut down.")
+	return db.Close()
+}
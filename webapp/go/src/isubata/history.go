@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// History is paged with message ID cursors: before_id shows the messages older than
+// the ID and after_id those newer than it, so that pages do not shift when messages
+// are posted and deep pages cost no more than the first one. date jumps to the first
+// message posted on or after a day (YYYY-MM-DD). Without any of them, the page has
+// the latest messages.
+//
+// The HTML page also has a numbered pager of page, counting pages of
+// historyPageSize messages from the latest one.
+
+const historyPageSize = 20
+
+var errHistoryPageNotFound = errors.New("history page out of range")
+
+type HistoryCursor struct {
+	BeforeID int64
+	AfterID  int64
+	Date     time.Time
+	Page     int64
+}
+
+// parseHistoryCursor reads at most one of before_id, after_id, date and page.
+// Its errors are 400 errors telling what is wrong.
+func parseHistoryCursor(c echo.Context) (HistoryCursor, error) {
+	var cur HistoryCursor
+	n := 0
+	for _, p := range []struct {
+		name string
+		dst  *int64
+		min  int64
+	}{
+		{"before_id", &cur.BeforeID, 1},
+		{"after_id", &cur.AfterID, 0},
+		{"page", &cur.Page, 1},
+	} {
+		s := c.QueryParam(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v < p.min {
+			return cur, echo.NewHTTPError(http.StatusBadRequest, "invalid "+p.name)
+		}
+		*p.dst = v
+		n++
+	}
+	if s := c.QueryParam("date"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return cur, echo.NewHTTPError(http.StatusBadRequest, "invalid date: use YYYY-MM-DD")
+		}
+		cur.Date = t
+		n++
+	}
+	if n > 1 {
+		return cur, echo.NewHTTPError(http.StatusBadRequest, "use only one of before_id, after_id, date and page")
+	}
+	return cur, nil
+}
+
+// HistoryPage is a page of top-level messages, oldest first.
+// OlderBeforeID and NewerAfterID are the cursors of the adjacent pages, 0 if there
+// is none.
+type HistoryPage struct {
+	Messages      []map[string]interface{}
+	OlderBeforeID int64
+	NewerAfterID  int64
+}
+
+const historyWhere = "channel_id = ? AND parent_id = 0 AND deleted_at IS NULL"
+
+// resolveHistoryCursor turns date and page into before_id or after_id.
+func resolveHistoryCursor(ctx context.Context, chID int64, cur HistoryCursor) (HistoryCursor, error) {
+	switch {
+	case !cur.Date.IsZero():
+		var ids []int64
+		err := db.SelectContext(ctx, &ids, "SELECT id FROM message WHERE "+historyWhere+
+			" AND created_at >= ? ORDER BY id LIMIT 1", chID, cur.Date)
+		if err != nil {
+			return cur, err
+		}
+		if len(ids) > 0 {
+			// otherwise nothing was posted since: show the latest messages
+			cur.AfterID = ids[0] - 1
+		}
+	case cur.Page > 1:
+		var ids []int64
+		err := db.SelectContext(ctx, &ids, "SELECT id FROM message WHERE "+historyWhere+
+			" ORDER BY id DESC LIMIT 1 OFFSET ?", chID, (cur.Page-1)*historyPageSize)
+		if err != nil {
+			return cur, err
+		}
+		if len(ids) == 0 {
+			return cur, errHistoryPageNotFound
+		}
+		cur.BeforeID = ids[0] + 1
+	}
+	return cur, nil
+}
+
+// historyPageCount returns the number of pages of the channel for page, at least 1.
+func historyPageCount(ctx context.Context, chID int64) (int64, error) {
+	var count int64
+	err := db.GetContext(ctx, &count, "SELECT message_count FROM channel_counter WHERE channel_id = ?", chID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if count <= 0 {
+		return 1, nil
+	}
+	return (count + historyPageSize - 1) / historyPageSize, nil
+}
+
+func historyExists(ctx context.Context, chID int64, cond string, id int64) (bool, error) {
+	var exists bool
+	err := db.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM message WHERE "+historyWhere+" AND "+cond+")", chID, id)
+	return exists, err
+}
+
+// queryHistoryPage returns the page of the channel at the cursor. It returns
+// errHistoryPageNotFound for a page out of range.
+func queryHistoryPage(ctx context.Context, chID int64, cur HistoryCursor) (*HistoryPage, error) {
+	const N = historyPageSize
+	cur, err := resolveHistoryCursor(ctx, chID, cur)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+	var hasOlder, hasNewer bool
+	if cur.AfterID > 0 {
+		err = db.SelectContext(ctx, &messages, "SELECT * FROM message WHERE "+historyWhere+
+			" AND id > ? ORDER BY id LIMIT ?", chID, cur.AfterID, N+1)
+		if err != nil {
+			return nil, err
+		}
+		if hasNewer = len(messages) > N; hasNewer {
+			messages = messages[:N]
+		}
+		first := cur.AfterID + 1
+		if len(messages) > 0 {
+			first = messages[0].ID
+		}
+		if hasOlder, err = historyExists(ctx, chID, "id < ?", first); err != nil {
+			return nil, err
+		}
+	} else {
+		q := "SELECT * FROM message WHERE " + historyWhere
+		args := []interface{}{chID}
+		if cur.BeforeID > 0 {
+			q += " AND id < ?"
+			args = append(args, cur.BeforeID)
+		}
+		err = db.SelectContext(ctx, &messages, q+" ORDER BY id DESC LIMIT ?", append(args, N+1)...)
+		if err != nil {
+			return nil, err
+		}
+		if hasOlder = len(messages) > N; hasOlder {
+			messages = messages[:N]
+		}
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+		if cur.BeforeID > 0 {
+			last := cur.BeforeID - 1
+			if len(messages) > 0 {
+				last = messages[len(messages)-1].ID
+			}
+			if hasNewer, err = historyExists(ctx, chID, "id > ?", last); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	page := &HistoryPage{}
+	if page.Messages, err = jsonifyMessages(ctx, messages); err != nil {
+		return nil, err
+	}
+	if hasOlder {
+		page.OlderBeforeID = cur.AfterID + 1
+		if len(messages) > 0 {
+			page.OlderBeforeID = messages[0].ID
+		}
+	}
+	if hasNewer {
+		page.NewerAfterID = cur.BeforeID - 1
+		if len(messages) > 0 {
+			page.NewerAfterID = messages[len(messages)-1].ID
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EventPost     = "post"
+	EventEdit     = "edit"
+	EventDelete   = "delete"
+	EventReply    = "reply"
+	EventReaction = "reaction"
+	EventMember   = "member"
+	EventChannel  = "channel"
+)
+
+// Event is published to the hub whenever something in a channel changes.
+// ParentID is set for EventReply.
+type Event struct {
+	Type      string
+	ChannelID int64
+	MessageID int64
+	ParentID  int64
+}
+
+// Subscriber receives the events from the hub accepted by its filter.
+// C is buffered; when a subscriber falls behind, further events are dropped
+// and Overflowed reports it, so that the subscriber can resync everything from
+// the database since it cannot tell which changes it missed.
+type Subscriber struct {
+	C        chan Event
+	filter   func(Event) bool
+	overflow int32
+}
+
+// Overflowed reports whether events were dropped since the last call.
+func (s *Subscriber) Overflowed() bool {
+	return atomic.SwapInt32(&s.overflow, 0) != 0
+}
+
+// Hub is an in-process notification hub fanning out channel events to
+// every connected stream.
+//
+// It also keeps a version number that grows on every event and the version of
+// the last change of each channel, so that long-polling clients can wait for
+// changes newer than a token they got earlier.
+// The versions start from the process start time in microseconds so that tokens
+// issued by a previous process are older than the current ones, while staying
+// within the integer precision of JavaScript numbers.
+type Hub struct {
+	mu       sync.Mutex
+	subs     map[*Subscriber]struct{}
+	base     int64
+	version  int64
+	channels map[int64]int64
+	changed  chan struct{}
+	closed   chan struct{}
+}
+
+func NewHub() *Hub {
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	return &Hub{
+		subs:     map[*Subscriber]struct{}{},
+		base:     now,
+		version:  now,
+		channels: map[int64]int64{},
+		changed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+var hub = NewHub()
+
+// Subscribe returns a subscriber to the events accepted by filter, or every event if
+// filter is nil. filter is called with the hub locked and must not block.
+func (h *Hub) Subscribe(filter func(Event) bool) *Subscriber {
+	s := &Subscriber{C: make(chan Event, 16), filter: filter}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+// Close ends every wait, on shutdown. Waits started later return at once.
+func (h *Hub) Close() {
+	close(h.closed)
+}
+
+// Done is closed when the hub is closed.
+func (h *Hub) Done() <-chan struct{} {
+	return h.closed
+}
+
+// Subscribers returns the number of subscribers.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func (h *Hub) Publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.version++
+	h.channels[ev.ChannelID] = h.version
+	close(h.changed)
+	h.changed = make(chan struct{})
+
+	for s := range h.subs {
+		if s.filter != nil && !s.filter(ev) {
+			continue
+		}
+		select {
+		case s.C <- ev:
+		default:
+			atomic.StoreInt32(&s.overflow, 1)
+		}
+	}
+}
+
+// Version returns the current version.
+func (h *Hub) Version() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.version
+}
+
+// Wait blocks until a channel accepted by filter (every channel if filter is nil)
+// changes after the version since, or until ctx is done or the hub is closed.
+// It returns the current version and whether such a change happened.
+// A token older than this process is always reported as changed.
+func (h *Hub) Wait(ctx context.Context, since int64, filter func(chID int64) bool) (int64, bool) {
+	for {
+		h.mu.Lock()
+		version := h.version
+		if since < h.base || version < since {
+			h.mu.Unlock()
+			return version, true
+		}
+		for chID, v := range h.channels {
+			if since < v && (filter == nil || filter(chID)) {
+				h.mu.Unlock()
+				return version, true
+			}
+		}
+		changed := h.changed
+		h.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return version, false
+		case <-h.closed:
+			return version, false
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Avatar images are content-addressed: uploads are named after the SHA-1 of their
+// data, so an image is never modified once stored and can be put twice.
+//
+// They are kept in an ImageStore, selected by the image-store setting:
+// "mysql" (the image table), "fs" (files under image-dir) or "s3" (a bucket of an
+// S3-compatible service). Images already in the image table are moved to the
+// other stores by "isubata migrate-images".
+
+// imageDeleteBatch is how many images are deleted by one query or request.
+const imageDeleteBatch = 1000
+
+var errImageNotFound = errors.New("image not found")
+
+type ImageStore interface {
+	// Get returns errImageNotFound if there is no image of that name.
+	Get(ctx context.Context, name string) ([]byte, error)
+	// ModTime returns when the image was stored without reading it, or
+	// errImageNotFound.
+	ModTime(ctx context.Context, name string) (time.Time, error)
+	Put(ctx context.Context, name string, data []byte) error
+	// Delete deletes the images of those names, ignoring the missing ones.
+	Delete(ctx context.Context, names ...string) error
+	// List returns the names of every image.
+	List(ctx context.Context) ([]string, error)
+}
+
+var imageStore ImageStore
+
+// validImageName keeps names usable as file names and object keys.
+var validImageName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func newImageStore() ImageStore {
+	switch cfg.ImageStore {
+	case "mysql":
+		return mysqlImageStore{}
+	case "fs":
+		return &fsImageStore{Dir: cfg.ImageDir}
+	case "s3":
+		return &s3ImageStore{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+		}
+	}
+	log.Fatalf("unknown image store: %q", cfg.ImageStore)
+	return nil
+}
+
+// mysqlImageStore keeps images in the image table. The initial data has a row per
+// user with the same name for users sharing an avatar, so names are indexed but
+// not unique.
+type mysqlImageStore struct{}
+
+func (mysqlImageStore) Get(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	err := db.QueryRowContext(ctx, "SELECT data FROM image WHERE name = ? LIMIT 1", name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errImageNotFound
+	}
+	return data, err
+}
+
+func (mysqlImageStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	var t time.Time
+	err := db.GetContext(ctx, &t, "SELECT created_at FROM image WHERE name = ? ORDER BY id LIMIT 1", name)
+	if err == sql.ErrNoRows {
+		return t, errImageNotFound
+	}
+	return t, err
+}
+
+func (mysqlImageStore) Put(ctx context.Context, name string, data []byte) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO image (name, data)"+
+		" SELECT ?, ? FROM DUAL WHERE NOT EXISTS (SELECT 1 FROM image WHERE name = ?)",
+		name, data, name)
+	return err
+}
+
+func (mysqlImageStore) Delete(ctx context.Context, names ...string) error {
+	for len(names) > 0 {
+		n := imageDeleteBatch
+		if len(names) < n {
+			n = len(names)
+		}
+		query, args, err := sqlx.In("DELETE FROM image WHERE name IN (?)", names[:n])
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		names = names[n:]
+	}
+	return nil
+}
+
+func (mysqlImageStore) List(ctx context.Context) ([]string, error) {
+	names := []string{}
+	err := db.SelectContext(ctx, &names, "SELECT DISTINCT name FROM image")
+	return names, err
+}
+
+// fsImageStore keeps each image in a file of Dir named after it.
+type fsImageStore struct {
+	Dir string
+}
+
+func (s *fsImageStore) path(name string) (string, error) {
+	if !validImageName.MatchString(name) {
+		return "", errImageNotFound
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+func (s *fsImageStore) Get(ctx context.Context, name string) ([]byte, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errImageNotFound
+	}
+	return data, err
+}
+
+func (s *fsImageStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, errImageNotFound
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// Put writes to a temporary file and renames it, so that readers never see
+// a partial image.
+func (s *fsImageStore) Put(ctx context.Context, name string, data []byte) error {
+	path, err := s.path(name)
+	if err != nil {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *fsImageStore) Delete(ctx context.Context, names ...string) error {
+	for _, name := range names {
+		path, err := s.path(name)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsImageStore) List(ctx context.Context) ([]string, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, fi := range files {
+		// Skips the temporary files of Put.
+		if fi.Mode().IsRegular() && validImageName.MatchString(fi.Name()) {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// resetImages deletes the images no user refers to, with their thumbnails, for
+// /initialize: those are the uploads of the users it deleted.
+func resetImages(ctx context.Context) error {
+	avatars := []string{}
+	err := db.SelectContext(ctx, &avatars, "SELECT DISTINCT avatar_icon FROM user WHERE avatar_icon IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for _, name := range append(avatars, "default.png") {
+		keep[name] = true
+		for _, size := range thumbnailSizes {
+			keep[thumbnailName(name, size)] = true
+		}
+	}
+
+	names, err := imageStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	unused := []string{}
+	for _, name := range names {
+		if !keep[name] {
+			unused = append(unused, name)
+		}
+	}
+	return imageStore.Delete(ctx, unused...)
+}
+
+// migrateImages moves the images of the image table to the configured store,
+// deleting each row once its image is stored. It can be run again after a failure.
+func migrateImages() error {
+	if _, ok := imageStore.(mysqlImageStore); ok {
+		return errors.New("image-store is mysql: nothing to migrate")
+	}
+
+	type row struct {
+		ID   int64  `db:"id"`
+		Name string `db:"name"`
+		Data []byte `db:"data"`
+	}
+	var lastID int64
+	moved := 0
+	for {
+		rows := []row{}
+		err := db.Select(&rows, "SELECT id, name, data FROM image WHERE id > ? ORDER BY id LIMIT 100", lastID)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, r := range rows {
+			lastID = r.ID
+			if !validImageName.MatchString(r.Name) {
+				log.Printf("Skipping image %d with invalid name %q.", r.ID, r.Name)
+				continue
+			}
+			if err := imageStore.Put(context.Background(), r.Name, r.Data); err != nil {
+				return fmt.Errorf("image %d (%s): %v", r.ID, r.Name, err)
+			}
+			if _, err := db.Exec("DELETE FROM image WHERE id = ?", r.ID); err != nil {
+				return err
+			}
+			moved++
+		}
+		log.Printf("Moved %d images.", moved)
+	}
+	return nil
+}
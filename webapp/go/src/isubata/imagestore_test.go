@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testImageStore checks the behavior every ImageStore must have.
+func testImageStore(t *testing.T, s ImageStore) {
+	ctx := context.Background()
+	if _, err := s.Get(ctx, "a.png"); err != errImageNotFound {
+		t.Fatalf("Get of a missing image: err = %v, want errImageNotFound", err)
+	}
+	if _, err := s.ModTime(ctx, "a.png"); err != errImageNotFound {
+		t.Fatalf("ModTime of a missing image: err = %v, want errImageNotFound", err)
+	}
+	if names, err := s.List(ctx); err != nil || len(names) != 0 {
+		t.Fatalf("List of an empty store = %v, %v", names, err)
+	}
+
+	for _, name := range []string{"a.png", "a.png", "b.png", "c.jpg"} {
+		if err := s.Put(ctx, name, []byte("data of "+name)); err != nil {
+			t.Fatalf("Put(%q): %v", name, err)
+		}
+	}
+	data, err := s.Get(ctx, "a.png")
+	if err != nil || !bytes.Equal(data, []byte("data of a.png")) {
+		t.Fatalf("Get(a.png) = %q, %v", data, err)
+	}
+
+	if mt, err := s.ModTime(ctx, "a.png"); err != nil || mt.IsZero() || time.Since(mt) > time.Minute {
+		t.Errorf("ModTime(a.png) = %v, %v", mt, err)
+	}
+
+	if err := s.Put(ctx, "../x.png", []byte("x")); err == nil {
+		t.Errorf("Put of an invalid name succeeded")
+	}
+	if _, err := s.Get(ctx, "../x.png"); err != errImageNotFound {
+		t.Errorf("Get of an invalid name: err = %v, want errImageNotFound", err)
+	}
+
+	names, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if want := []string{"a.png", "b.png", "c.jpg"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List = %v, want %v", names, want)
+	}
+
+	if err := s.Delete(ctx, "a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "a.png"); err != nil {
+		t.Errorf("Delete of a missing image: %v", err)
+	}
+	if _, err := s.Get(ctx, "a.png"); err != errImageNotFound {
+		t.Errorf("Get of a deleted image: err = %v, want errImageNotFound", err)
+	}
+	for _, name := range []string{"d.png", "e.gif"} {
+		if err := s.Put(ctx, name, []byte("data of "+name)); err != nil {
+			t.Fatalf("Put(%q): %v", name, err)
+		}
+	}
+	if err := s.Delete(ctx, "d.png", "missing.png", "../x.png", "e.gif"); err != nil {
+		t.Fatalf("Delete of several images: %v", err)
+	}
+	names, err = s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if want := []string{"b.png", "c.jpg"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List after Delete = %v, want %v", names, want)
+	}
+}
+
+func TestFSImageStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "icons")
+	testImageStore(t, &fsImageStore{Dir: dir})
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("%d files left in the directory, want 2", len(files))
+	}
+}
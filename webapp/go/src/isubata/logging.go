@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Logs are JSON lines on stdout. Every request gets an ID, taken from X-Request-ID
+// when the client sends one (the benchmarker does in debug mode) and echoed back
+// in the response, so that a failed check can be found in the app log.
+//
+// Queries are logged at debug level with the ID of the request that ran them:
+// requestLogger puts the ID in the request context, which handlers pass to the
+// DB calls.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (l logLevel) String() string {
+	for name, level := range logLevelNames {
+		if level == l {
+			return name
+		}
+	}
+	return strconv.Itoa(int(l))
+}
+
+var (
+	minLogLevel = levelInfo
+
+	logMu  sync.Mutex
+	logOut io.Writer = os.Stdout
+)
+
+// logFields is the extra data of a log line.
+type logFields map[string]interface{}
+
+func logAt(level logLevel, msg string, fields logFields) {
+	if level < minLogLevel {
+		return
+	}
+	line := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		line[k] = v
+	}
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = msg
+	b, err := json.Marshal(line)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"level":"error","msg":"cannot encode log line: %v"}`, err))
+	}
+	logMu.Lock()
+	logOut.Write(append(b, '\n'))
+	logMu.Unlock()
+}
+
+func logDebugEnabled() bool {
+	return minLogLevel <= levelDebug
+}
+
+// stdLogWriter turns the lines of the standard logger into info lines.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logAt(levelInfo, string(bytes.TrimRight(p, "\n")), nil)
+	return len(p), nil
+}
+
+func setupLogging(level string) {
+	if l, ok := logLevelNames[level]; ok {
+		minLogLevel = l
+	}
+}
+
+const (
+	headerRequestID = "X-Request-ID"
+	maxRequestIDLen = 128
+)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(c echo.Context) string {
+	id, _ := c.Get("request_id").(string)
+	return id
+}
+
+type requestIDKey struct{}
+
+// contextRequestID returns the ID of the request of ctx, or "" outside requests.
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// responseStatus returns the status sent for the error returned by a handler.
+func responseStatus(c echo.Context, err error) int {
+	if err == nil {
+		return c.Response().Status
+	}
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// requestLogger assigns the request ID and logs one line per request.
+func requestLogger(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(headerRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set("request_id", id)
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+		c.Response().Header().Set(headerRequestID, id)
+
+		start := time.Now()
+		err := next(c)
+
+		status := responseStatus(c, err)
+		route := routeLabel(c)
+		fields := logFields{
+			"request_id": id,
+			"method":     req.Method,
+			"uri":        req.RequestURI,
+			"route":      route,
+			"status":     status,
+			"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"bytes_out":  c.Response().Size,
+			"remote_ip":  clientIP(c.Request()),
+		}
+		// Static files do not load the session; do not load it just for the log.
+		if route != "unmatched" {
+			if userID := sessUserID(c); userID != 0 {
+				fields["user_id"] = userID
+			}
+		}
+		if name := req.Header.Get("X-Username"); name != "" {
+			fields["username"] = name
+		}
+		level := levelInfo
+		if err != nil && status >= http.StatusInternalServerError {
+			fields["error"] = err.Error()
+			level = levelError
+		}
+		logAt(level, "request", fields)
+		return err
+	}
+}
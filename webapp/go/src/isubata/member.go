@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// Private channels are only visible to their members, listed in channel_member.
+// Public channels are open to everyone and have no members.
+// Members of direct messages are fixed when they are opened.
+
+// checkChannelAccess returns echo.ErrNotFound unless the channel exists and is public
+// or the user is a member of it, so that the existence of private channels does not
+// leak either.
+func checkChannelAccess(ctx context.Context, userID, chID int64) error {
+	var ok bool
+	err := db.GetContext(ctx, &ok,
+		"SELECT c.is_private = 0 OR m.user_id IS NOT NULL FROM channel c"+
+			" LEFT JOIN channel_member m ON m.channel_id = c.id AND m.user_id = ?"+
+			" WHERE c.id = ?",
+		userID, chID)
+	if err == sql.ErrNoRows {
+		return echo.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.ErrNotFound
+	}
+	return nil
+}
+
+func queryChannelMembers(ctx context.Context, chID int64) ([]User, error) {
+	users := []User{}
+	err := db.SelectContext(ctx, &users,
+		"SELECT u.* FROM channel_member m JOIN user u ON u.id = m.user_id"+
+			" WHERE m.channel_id = ? ORDER BY m.created_at, u.id",
+		chID)
+	return users, err
+}
+
+// privateChannelOf returns the private channel if the user is a member of it.
+func privateChannelOf(ctx context.Context, userID, chID int64) (*ChannelInfo, error) {
+	if err := checkChannelAccess(ctx, userID, chID); err != nil {
+		return nil, err
+	}
+	ch, err := getChannelInfo(ctx, chID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		return nil, echo.ErrNotFound
+	}
+	if !ch.IsPrivate {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "channel is public")
+	}
+	return ch, nil
+}
+
+// inviteMember adds the user name to the private channel. Any member can invite.
+func inviteMember(ctx context.Context, selfID, chID int64, name string) (*User, error) {
+	ch, err := privateChannelOf(ctx, selfID, chID)
+	if err != nil {
+		return nil, err
+	}
+	if ch.IsDirect {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "cannot change members of a direct message")
+	}
+	if ch.IsArchived {
+		return nil, errChannelArchived
+	}
+	u, err := getUserByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	_, err = db.ExecContext(ctx, "INSERT IGNORE INTO channel_member (channel_id, user_id, created_at) VALUES (?, ?, NOW())",
+		ch.ID, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	hub.Publish(Event{Type: EventMember, ChannelID: ch.ID})
+	return u, nil
+}
+
+// removeMember removes the user name from the private channel.
+// Members can remove themselves; only the owner of the channel can remove others.
+func removeMember(ctx context.Context, selfID, chID int64, name string) error {
+	ch, err := privateChannelOf(ctx, selfID, chID)
+	if err != nil {
+		return err
+	}
+	if ch.IsDirect {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot change members of a direct message")
+	}
+	u, err := getUserByName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	if u.ID != selfID && ch.OwnerID != selfID {
+		return echo.ErrForbidden
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM channel_member WHERE channel_id = ? AND user_id = ?", ch.ID, u.ID)
+	if err != nil {
+		return err
+	}
+	hub.Publish(Event{Type: EventMember, ChannelID: ch.ID})
+	return nil
+}
+
+func channelIDParam(c echo.Context) (int64, error) {
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || chID <= 0 {
+		return 0, ErrBadReqeust
+	}
+	return chID, nil
+}
+
+func postInvite(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	name := c.FormValue("name")
+	if name == "" {
+		return ErrBadReqeust
+	}
+	if _, err := inviteMember(c.Request().Context(), self.ID, chID, name); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", chID))
+}
+
+func postKick(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	name := c.FormValue("name")
+	if name == "" || name == self.Name {
+		return ErrBadReqeust
+	}
+	if err := removeMember(c.Request().Context(), self.ID, chID, name); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", chID))
+}
+
+func postLeave(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	chID, err := channelIDParam(c)
+	if err != nil {
+		return err
+	}
+	if err := removeMember(c.Request().Context(), self.ID, chID, self.Name); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
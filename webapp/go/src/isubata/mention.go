@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	recentMentionsLimit = 20
+)
+
+var mentionRe = regexp.MustCompile(`@([0-9A-Za-z_][0-9A-Za-z_.\-]*)`)
+
+// extractMentionNames returns the distinct user names mentioned as @name in content.
+func extractMentionNames(content string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, m := range mentionRe.FindAllStringSubmatch(content, -1) {
+		name := strings.TrimRight(m[1], ".-")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// addMentions stores a mention row for every existing user mentioned in the message
+// who can see the channel, except its author, in the transaction posting the message.
+// parentID is the thread of a reply, 0 for a top-level message.
+//
+// A mention is unread until the user reads the channel, or the thread of a reply,
+// up to its message, or the message is deleted; is_unread is cleared then, so that
+// unread mentions are counted from the index of the user.
+func addMentions(ctx context.Context, tx *sqlx.Tx, msgID, chanID, parentID, userID int64, content string) error {
+	names := extractMentionNames(content)
+	if len(names) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(
+		"SELECT u.id FROM user u JOIN channel c ON c.id = ?"+
+			" LEFT JOIN channel_member m ON m.channel_id = c.id AND m.user_id = u.id"+
+			" WHERE u.name IN (?) AND (c.is_private = 0 OR m.user_id IS NOT NULL)",
+		chanID, names)
+	if err != nil {
+		return err
+	}
+	ids := []int64{}
+	if err := tx.SelectContext(ctx, &ids, query, args...); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if id == userID {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO mention (message_id, channel_id, parent_id, user_id, created_at)"+
+			" VALUES (?, ?, ?, ?, NOW())",
+			msgID, chanID, parentID, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryUnreadMentions returns, per channel, the number of unread mentions of the user.
+func queryUnreadMentions(ctx context.Context, userID int64) (map[int64]int64, error) {
+	type row struct {
+		ChannelID int64 `db:"channel_id"`
+		Cnt       int64 `db:"cnt"`
+	}
+	rows := []row{}
+	err := db.SelectContext(ctx, &rows,
+		"SELECT channel_id, COUNT(*) AS cnt FROM mention WHERE user_id = ? AND is_unread = 1 GROUP BY channel_id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int64]int64, len(rows))
+	for _, r := range rows {
+		res[r.ChannelID] = r.Cnt
+	}
+	return res, nil
+}
+
+// readMentions marks the mentions of the user up to msgID in the channel as read,
+// or in the thread parentID if it is not 0.
+func readMentions(ctx context.Context, tx *sqlx.Tx, userID, chanID, parentID, msgID int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE mention SET is_unread = 0"+
+		" WHERE user_id = ? AND is_unread = 1 AND channel_id = ? AND parent_id = ? AND message_id <= ?",
+		userID, chanID, parentID, msgID)
+	return err
+}
+
+// queryRecentMentions returns the latest messages mentioning the user in the channels
+// they can still see, newest first, with the name of their channel as "channel_name".
+func queryRecentMentions(ctx context.Context, userID int64) ([]map[string]interface{}, error) {
+	messages := []Message{}
+	err := db.SelectContext(ctx, &messages,
+		"SELECT msg.* FROM mention m JOIN message msg ON msg.id = m.message_id"+
+			" JOIN channel c ON c.id = m.channel_id"+
+			" LEFT JOIN channel_member cm ON cm.channel_id = c.id AND cm.user_id = m.user_id"+
+			" WHERE m.user_id = ? AND msg.deleted_at IS NULL AND (c.is_private = 0 OR cm.user_id IS NOT NULL)"+
+			" ORDER BY m.id DESC LIMIT ?",
+		userID, recentMentionsLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	mentions, err := jsonifyMessages(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+	chIDs := make([]int64, 0, len(messages))
+	for _, m := range messages {
+		chIDs = append(chIDs, m.ChannelID)
+	}
+	names, err := queryChannelNames(ctx, chIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range messages {
+		r := mentions[i]
+		r["channel_id"] = m.ChannelID
+		if name, ok := names[m.ChannelID]; ok {
+			r["channel_name"] = name
+		}
+	}
+	return mentions, nil
+}
+
+// queryChannelNames returns the names of the channels of the IDs.
+func queryChannelNames(ctx context.Context, ids []int64) (map[int64]string, error) {
+	names := make(map[int64]string, len(ids))
+	if len(ids) == 0 {
+		return names, nil
+	}
+	query, args, err := sqlx.In("SELECT id, name FROM channel WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	rows := []ChannelInfo{}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, ch := range rows {
+		names[ch.ID] = ch.Name
+	}
+	return names, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Messages are rendered for clients by jsonifyMessages, which loads the authors and
+// the reactions of a whole list of messages in one query each, whatever its length.
+// Every handler returning messages, HTML or JSON, goes through it.
+
+// queryUsersByID returns the users of the IDs, with only the fields shown with
+// messages: name, display_name and avatar_icon.
+func queryUsersByID(ctx context.Context, ids []int64) (map[int64]User, error) {
+	users := make(map[int64]User, len(ids))
+	if len(ids) == 0 {
+		return users, nil
+	}
+	query, args, err := sqlx.In("SELECT id, name, display_name, avatar_icon FROM user WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	rows := []User{}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, u := range rows {
+		users[u.ID] = u
+	}
+	return users, nil
+}
+
+func jsonifyMessage(ctx context.Context, m Message) (map[string]interface{}, error) {
+	r, err := jsonifyMessages(ctx, []Message{m})
+	if err != nil {
+		return nil, err
+	}
+	return r[0], nil
+}
+
+// jsonifyMessages renders the messages in the same order.
+func jsonifyMessages(ctx context.Context, messages []Message) ([]map[string]interface{}, error) {
+	userIDs := make([]int64, 0, len(messages))
+	msgIDs := make([]int64, 0, len(messages))
+	seen := map[int64]bool{}
+	for _, m := range messages {
+		if !seen[m.UserID] {
+			seen[m.UserID] = true
+			userIDs = append(userIDs, m.UserID)
+		}
+		msgIDs = append(msgIDs, m.ID)
+	}
+	users, err := queryUsersByID(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	reactions, err := queryReactionsOf(ctx, msgIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]map[string]interface{}, 0, len(messages))
+	for _, m := range messages {
+		u, ok := users[m.UserID]
+		if !ok {
+			return nil, fmt.Errorf("user %d of message %d not found", m.UserID, m.ID)
+		}
+
+		r := make(map[string]interface{})
+		r["id"] = m.ID
+		r["user"] = u
+		r["date"] = m.CreatedAt.Format("2006/01/02 15:04:05")
+		r["content"] = m.Content
+		if m.EditedAt.Valid {
+			r["edited_at"] = m.EditedAt.Time.Format("2006/01/02 15:04:05")
+		}
+		r["reactions"] = reactions[m.ID]
+		if m.ParentID != 0 {
+			r["parent_id"] = m.ParentID
+		} else {
+			r["reply_count"] = m.ReplyCount
+			if m.LastReplyAt.Valid {
+				r["last_reply_at"] = m.LastReplyAt.Time.Format("2006/01/02 15:04:05")
+			}
+		}
+		response = append(response, r)
+	}
+	return response, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Metrics in the Prometheus text exposition format, served on /metrics.
+// There is no client library in vendor, so this file has the few metric types
+// we need: counters, histograms and gauges read at scrape time.
+
+var defaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+var collectors []collector
+
+func registerCollector(c collector) {
+	collectors = append(collectors, c)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{name: name, help: help, labels: labels,
+		values: map[string]float64{}, keys: map[string][]string{}}
+	registerCollector(v)
+	return v
+}
+
+func (v *CounterVec) Add(delta float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	v.mu.Lock()
+	if _, ok := v.keys[key]; !ok {
+		v.keys[key] = labelValues
+	}
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *CounterVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *CounterVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	writeHeader(w, v.name, v.help, "counter")
+	for _, key := range sortedKeys(v.keys) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.keys[key]), formatFloat(v.values[key]))
+	}
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets,
+		series: map[string]*histogram{}}
+	registerCollector(v)
+	return v
+}
+
+func (v *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{labelValues: labelValues, counts: make([]uint64, len(v.buckets))}
+		v.series[key] = h
+	}
+	if i := sort.SearchFloat64s(v.buckets, value); i < len(v.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+func (v *HistogramVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	writeHeader(w, v.name, v.help, "histogram")
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := v.series[key]
+		var cumulative uint64
+		for i, le := range v.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name,
+				formatLabels(v.labels, h.labelValues, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, h.labelValues, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, h.labelValues), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, h.labelValues), h.count)
+	}
+}
+
+// GaugeFunc is a gauge, or a counter maintained elsewhere, read when scraped.
+type GaugeFunc struct {
+	name, help, typ string
+	fn              func() (float64, error)
+}
+
+func NewGaugeFunc(name, help string, fn func() (float64, error)) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, typ: "gauge", fn: fn}
+	registerCollector(g)
+	return g
+}
+
+func NewCounterFunc(name, help string, fn func() (float64, error)) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, typ: "counter", fn: fn}
+	registerCollector(g)
+	return g
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) {
+	v, err := g.fn()
+	if err != nil {
+		log.Printf("metrics: %s: %v", g.name, err)
+		return
+	}
+	writeHeader(w, g.name, g.help, g.typ)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(v))
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	httpRequests = NewCounterVec("isubata_http_requests_total",
+		"HTTP requests by route and status.", "method", "route", "status")
+	httpDuration = NewHistogramVec("isubata_http_request_duration_seconds",
+		"HTTP request latency by route.", defaultBuckets, "method", "route")
+
+	messagesPosted = NewCounterVec("isubata_messages_posted_total",
+		"Messages posted, by kind (message or reply).", "kind")
+	rateLimited = NewCounterVec("isubata_rate_limited_total",
+		"Requests rejected by rate limit policy.", "policy")
+)
+
+func init() {
+	NewGaugeFunc("isubata_db_open_connections", "Open DB connections.", func() (float64, error) {
+		return float64(db.Stats().OpenConnections), nil
+	})
+	NewGaugeFunc("isubata_db_in_use_connections", "DB connections in use.", func() (float64, error) {
+		return float64(db.Stats().InUse), nil
+	})
+	NewGaugeFunc("isubata_db_idle_connections", "Idle DB connections.", func() (float64, error) {
+		return float64(db.Stats().Idle), nil
+	})
+	NewGaugeFunc("isubata_db_max_open_connections", "Maximum open DB connections.", func() (float64, error) {
+		return float64(db.Stats().MaxOpenConnections), nil
+	})
+	NewCounterFunc("isubata_db_wait_count_total", "Waits for a DB connection.", func() (float64, error) {
+		return float64(db.Stats().WaitCount), nil
+	})
+	NewCounterFunc("isubata_db_wait_duration_seconds_total", "Time spent waiting for a DB connection.", func() (float64, error) {
+		return db.Stats().WaitDuration.Seconds(), nil
+	})
+
+	NewGaugeFunc("isubata_active_sessions", "Sessions that have not expired.", func() (float64, error) {
+		n, err := sessionStore.Backend.Count()
+		return float64(n), err
+	})
+	NewGaugeFunc("isubata_stream_subscribers", "Clients connected to /stream.", func() (float64, error) {
+		return float64(hub.Subscribers()), nil
+	})
+}
+
+var (
+	routePathsOnce sync.Once
+	routePaths     map[string]bool
+)
+
+// routeLabel returns the pattern of the route that matched the request, or
+// "unmatched" for static files and unknown paths.
+func routeLabel(c echo.Context) string {
+	routePathsOnce.Do(func() {
+		routePaths = map[string]bool{}
+		for _, r := range c.Echo().Routes() {
+			routePaths[r.Path] = true
+		}
+	})
+	if routePaths[c.Path()] {
+		return c.Path()
+	}
+	return "unmatched"
+}
+
+// metricsMiddleware counts requests and their latency by route pattern.
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		method := c.Request().Method
+		route := routeLabel(c)
+		httpRequests.Inc(method, route, strconv.Itoa(responseStatus(c, err)))
+		httpDuration.Observe(time.Since(start).Seconds(), method, route)
+		return err
+	}
+}
+
+func getMetrics(c echo.Context) error {
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriter(w)
+	for _, col := range collectors {
+		col.writeTo(bw)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are stored as bcrypt hashes, which carry their own salt and cost.
+// Users registered before bcrypt have sha1(salt+password) in password and a
+// 20-character salt; their hash is upgraded on their next successful login.
+
+const (
+	passwordCost = bcrypt.DefaultCost
+)
+
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(b), err
+}
+
+func isLegacyHash(hash string) bool {
+	return !strings.HasPrefix(hash, "$2")
+}
+
+// checkPassword reports whether password matches the user's hash, and whether
+// the hash should be replaced because it is legacy or has another cost.
+func checkPassword(u *User, password string) (ok, rehash bool) {
+	if isLegacyHash(u.Password) {
+		digest := fmt.Sprintf("%x", sha1.Sum([]byte(u.Salt+password)))
+		return subtle.ConstantTimeCompare([]byte(digest), []byte(u.Password)) == 1, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(u.Password))
+	return true, err != nil || cost != passwordCost
+}
+
+// upgradePassword replaces the hash of the user with a bcrypt hash of password.
+func upgradePassword(ctx context.Context, u *User, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE user SET salt = '', password = ? WHERE id = ?", hash, u.ID)
+	if err != nil {
+		return err
+	}
+	u.Salt = ""
+	u.Password = hash
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Rate limiting with token buckets. Each policy has a bucket per user, or per client
+// IP for requests without a session (and for policies keyed by IP only).
+// login-account has a bucket per account name tried, so that an account cannot be
+// guessed at from many addresses.
+//
+// Every policy is off by default: the benchmark logs in and registers from one
+// address at a far higher rate than people would. They are enabled with the
+// rate-limits setting, a comma-separated list of name=count/unit:burst (unit is s, m
+// or h), e.g. "login=20/m:20,login-account=10/m:10,register=10/m:10,message=5/s:20".
+// A count of 0 disables the policy.
+
+// RateLimitPolicy allows Rate requests per second on average and bursts of Burst requests.
+type RateLimitPolicy struct {
+	Name   string
+	Rate   float64
+	Burst  float64
+	ByUser bool
+}
+
+var defaultRateLimits = []RateLimitPolicy{
+	{Name: "login"},
+	{Name: "login-account"},
+	{Name: "register"},
+	{Name: "message", ByUser: true},
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type RateLimiter struct {
+	policy RateLimitPolicy
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(p RateLimitPolicy) *RateLimiter {
+	return &RateLimiter{policy: p, buckets: map[string]*tokenBucket{}}
+}
+
+// Allow takes a token from the bucket of key. If there is none, it returns false
+// and how long to wait for the next one.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.policy.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.policy.Burst, b.tokens+now.Sub(b.last).Seconds()*l.policy.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.policy.Rate * float64(time.Second))
+}
+
+// sweep forgets the buckets that have refilled.
+func (l *RateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.policy.Rate >= l.policy.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimiters holds the enabled policies by name.
+var rateLimiters = map[string]*RateLimiter{}
+
+// parseRateLimit parses count/unit:burst.
+func parseRateLimit(p *RateLimitPolicy, spec string) error {
+	var countStr, unit, burstStr string
+	if i := strings.IndexByte(spec, '/'); i >= 0 {
+		countStr, unit = spec[:i], spec[i+1:]
+	} else {
+		return fmt.Errorf("missing unit in %q", spec)
+	}
+	if i := strings.IndexByte(unit, ':'); i >= 0 {
+		unit, burstStr = unit[:i], unit[i+1:]
+	}
+	count, err := strconv.ParseFloat(countStr, 64)
+	if err != nil {
+		return err
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return fmt.Errorf("unknown unit in %q", spec)
+	}
+	p.Rate = count / per.Seconds()
+	p.Burst = math.Max(1, count)
+	if burstStr != "" {
+		if p.Burst, err = strconv.ParseFloat(burstStr, 64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupRateLimiters(specs string) error {
+	policies := map[string]RateLimitPolicy{}
+	for _, p := range defaultRateLimits {
+		policies[p.Name] = p
+	}
+	for _, item := range strings.Split(specs, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		p, ok := policies[kv[0]]
+		if !ok || len(kv) != 2 {
+			return fmt.Errorf("unknown rate limit %q", item)
+		}
+		if err := parseRateLimit(&p, kv[1]); err != nil {
+			return err
+		}
+		policies[p.Name] = p
+	}
+
+	for name, p := range policies {
+		if p.Rate > 0 {
+			rateLimiters[name] = NewRateLimiter(p)
+		}
+	}
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			for _, l := range rateLimiters {
+				l.sweep(now)
+			}
+		}
+	}()
+	return nil
+}
+
+func initRateLimiters() {
+	if err := setupRateLimiters(cfg.RateLimits); err != nil {
+		log.Fatal("rate limits: ", err)
+	}
+}
+
+// checkRateLimit takes a token of the policy name for key. Requests over the limit
+// get 429 Too Many Requests with Retry-After.
+func checkRateLimit(c echo.Context, name, key string) error {
+	l := rateLimiters[name]
+	if l == nil {
+		return nil
+	}
+	ok, wait := l.Allow(key, time.Now())
+	if !ok {
+		rateLimited.Inc(name)
+		secs := int(math.Ceil(wait.Seconds()))
+		c.Response().Header().Set("Retry-After", strconv.Itoa(secs))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+	}
+	return nil
+}
+
+// rateLimit applies the policy name to the route, by client IP or by user.
+func rateLimit(name string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			l := rateLimiters[name]
+			if l == nil {
+				return next(c)
+			}
+			key := "ip:" + clientIP(c.Request())
+			if l.policy.ByUser {
+				if userID := sessUserID(c); userID != 0 {
+					key = "user:" + strconv.FormatInt(userID, 10)
+				}
+			}
+			if err := checkRateLimit(c, name, key); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// limitLoginAccount limits the login attempts to the account name, whatever their address.
+func limitLoginAccount(c echo.Context, name string) error {
+	return checkRateLimit(c, "login-account", "name:"+name)
+}
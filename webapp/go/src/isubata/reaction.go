@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	reactionMaxRunes = 32
+
+	// reactionLogRetention is how long changes are kept for last_reaction_id.
+	// Clients polling less often than that get the reactions of the latest messages
+	// instead.
+	reactionLogRetention   = time.Hour
+	reactionLogGCInterval  = 10 * time.Minute
+	reactionResyncMessages = 100
+
+	// reactionReplayWindow is how many IDs below last_reaction_id are read again.
+	// IDs are assigned before commit, so a change can become visible after changes
+	// with higher IDs; a change committed more than that many IDs late is missed
+	// until the reactions of its message change again.
+	reactionReplayWindow = 100
+)
+
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int64    `json:"count"`
+	Users []string `json:"users"`
+}
+
+// queryReactions returns the reactions to the message aggregated per emoji,
+// in the order each emoji was first used.
+func queryReactions(ctx context.Context, msgID int64) ([]Reaction, error) {
+	reactions, err := queryReactionsOf(ctx, []int64{msgID})
+	if err != nil {
+		return nil, err
+	}
+	return reactions[msgID], nil
+}
+
+// queryReactionsOf returns the reactions to each of the messages, as queryReactions
+// does, in one query. Messages without reactions have an empty slice.
+func queryReactionsOf(ctx context.Context, msgIDs []int64) (map[int64][]Reaction, error) {
+	result := make(map[int64][]Reaction, len(msgIDs))
+	if len(msgIDs) == 0 {
+		return result, nil
+	}
+	for _, id := range msgIDs {
+		result[id] = []Reaction{}
+	}
+
+	type row struct {
+		MessageID int64  `db:"message_id"`
+		Emoji     string `db:"emoji"`
+		Name      string `db:"name"`
+	}
+	query, args, err := sqlx.In(
+		"SELECT r.message_id, r.emoji, u.name FROM reaction r JOIN user u ON u.id = r.user_id"+
+			" WHERE r.message_id IN (?) ORDER BY r.id", msgIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows := []row{}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	index := map[int64]map[string]int{}
+	for _, r := range rows {
+		if index[r.MessageID] == nil {
+			index[r.MessageID] = map[string]int{}
+		}
+		reactions := result[r.MessageID]
+		i, ok := index[r.MessageID][r.Emoji]
+		if !ok {
+			i = len(reactions)
+			index[r.MessageID][r.Emoji] = i
+			reactions = append(reactions, Reaction{Emoji: r.Emoji, Users: []string{}})
+		}
+		reactions[i].Count++
+		reactions[i].Users = append(reactions[i].Users, r.Name)
+		result[r.MessageID] = reactions
+	}
+	return result, nil
+}
+
+func validEmoji(emoji string) bool {
+	if emoji == "" || !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > reactionMaxRunes {
+		return false
+	}
+	return strings.IndexFunc(emoji, unicode.IsSpace) < 0
+}
+
+// reactableMessage returns the message if it exists, has not been deleted,
+// the user can see it and its channel is not archived.
+func reactableMessage(ctx context.Context, userID, msgID int64) (*Message, error) {
+	m, err := getMessageByID(ctx, msgID)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil || m.DeletedAt.Valid {
+		return nil, echo.ErrNotFound
+	}
+	if err := checkChannelAccess(ctx, userID, m.ChannelID); err != nil {
+		return nil, err
+	}
+	if err := checkChannelWritable(ctx, m.ChannelID); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// logReactionChange records that the reactions to the message changed,
+// for clients fetching changes incrementally with last_reaction_id.
+func logReactionChange(ctx context.Context, m *Message) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO reaction_log (channel_id, message_id, created_at) VALUES (?, ?, NOW())",
+		m.ChannelID, m.ID)
+	if err != nil {
+		return err
+	}
+	hub.Publish(Event{Type: EventReaction, ChannelID: m.ChannelID, MessageID: m.ID, ParentID: m.ParentID})
+	return nil
+}
+
+// addReaction is idempotent: reacting twice with the same emoji is a no-op.
+func addReaction(ctx context.Context, userID, msgID int64, emoji string) (*Message, error) {
+	m, err := reactableMessage(ctx, userID, msgID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO reaction (message_id, user_id, emoji, created_at) VALUES (?, ?, ?, NOW())",
+		m.ID, userID, emoji)
+	if err != nil {
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 { // Duplicate entry
+			return m, nil
+		}
+		return nil, err
+	}
+	return m, logReactionChange(ctx, m)
+}
+
+func removeReaction(ctx context.Context, userID, msgID int64, emoji string) (*Message, error) {
+	m, err := reactableMessage(ctx, userID, msgID)
+	if err != nil {
+		return nil, err
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM reaction WHERE message_id = ? AND user_id = ? AND emoji = ?",
+		m.ID, userID, emoji)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return m, nil
+	}
+	return m, logReactionChange(ctx, m)
+}
+
+// lastReactionID returns the ID of the latest change in any channel. Cursors are
+// global so that they keep moving forward, and stay within the log, while clients
+// poll a channel without reactions.
+func lastReactionID(ctx context.Context) (int64, error) {
+	var id int64
+	err := db.GetContext(ctx, &id, "SELECT IFNULL(MAX(id), 0) FROM reaction_log")
+	return id, err
+}
+
+// queryReactionChanges returns the current reactions of every message of the channel
+// whose reactions changed after lastID, and the ID to pass as last_reaction_id next time.
+// The changes of the last reactionReplayWindow IDs up to lastID are returned again.
+// If the changes after lastID have been pruned, it returns the reactions of the latest
+// messages of the channel.
+func queryReactionChanges(ctx context.Context, chanID, lastID int64) ([]map[string]interface{}, int64, error) {
+	var bounds struct {
+		OldestID int64 `db:"oldest_id"`
+		NextID   int64 `db:"next_id"`
+	}
+	err := db.GetContext(ctx, &bounds, "SELECT IFNULL(MIN(id), 0) AS oldest_id, IFNULL(MAX(id), 0) AS next_id FROM reaction_log")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ids := []int64{}
+	if lastID < bounds.OldestID-1 {
+		err = db.SelectContext(ctx, &ids, "SELECT id FROM message WHERE channel_id = ? AND parent_id = 0"+
+			" AND deleted_at IS NULL ORDER BY id DESC LIMIT ?", chanID, reactionResyncMessages)
+	} else {
+		err = db.SelectContext(ctx, &ids,
+			"SELECT message_id FROM reaction_log WHERE channel_id = ? AND id > ? AND id <= ?"+
+				" GROUP BY message_id ORDER BY MAX(id)",
+			chanID, lastID-reactionReplayWindow, bounds.NextID)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	reactions, err := queryReactionsOf(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	changes := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		changes = append(changes, map[string]interface{}{
+			"id":        id,
+			"reactions": reactions[id],
+		})
+	}
+	return changes, bounds.NextID, nil
+}
+
+// pruneReactionLog deletes the changes older than reactionLogRetention, keeping
+// the latest one so that cursors can be told from pruned ones.
+func pruneReactionLog() {
+	for range time.Tick(reactionLogGCInterval) {
+		lastID, err := lastReactionID(context.Background())
+		if err == nil {
+			_, err = db.Exec("DELETE FROM reaction_log WHERE created_at < ? AND id < ?",
+				time.Now().Add(-reactionLogRetention), lastID)
+		}
+		if err != nil {
+			log.Println("failed to prune reaction log:", err)
+		}
+	}
+}
+
+func reactionResponse(c echo.Context, m *Message, err error) error {
+	if err != nil {
+		return err
+	}
+	reactions, err := queryReactions(c.Request().Context(), m.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"id":        m.ID,
+		"reactions": reactions,
+	})
+}
+
+func postReaction(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+	emoji := c.FormValue("emoji")
+	if !validEmoji(emoji) {
+		return ErrBadReqeust
+	}
+
+	m, err := addReaction(c.Request().Context(), userID, msgID, emoji)
+	return reactionResponse(c, m, err)
+}
+
+func deleteReaction(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+	emoji := c.QueryParam("emoji")
+	if !validEmoji(emoji) {
+		return ErrBadReqeust
+	}
+
+	m, err := removeReaction(c.Request().Context(), userID, msgID, emoji)
+	return reactionResponse(c, m, err)
+}
+
+// getReactions returns the reactions of the messages of a channel changed after
+// last_reaction_id, so that clients polling GET /message learn about reactions to
+// messages they have already received. Messages whose reactions changed just before
+// last_reaction_id may be returned again:
+//
+//	{"last_reaction_id": 42, "messages": [{"id": 10001, "reactions": [{"emoji": "👍", "count": 1, "users": ["foo"]}]}]}
+func getReactions(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	chanID, err := strconv.ParseInt(c.QueryParam("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	if err := checkChannelAccess(c.Request().Context(), userID, chanID); err != nil {
+		return err
+	}
+	s := c.QueryParam("last_reaction_id")
+	if s == "" {
+		// Without last_reaction_id, only tell where to start from.
+		lastID, err := lastReactionID(c.Request().Context())
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"last_reaction_id": lastID,
+			"messages":         []map[string]interface{}{},
+		})
+	}
+	lastID, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	changes, lastID, err := queryReactionChanges(c.Request().Context(), chanID, lastID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"last_reaction_id": lastID,
+		"messages":         changes,
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3ImageStore keeps images as objects of a bucket of an S3-compatible service
+// (AWS S3, MinIO...), addressed path-style as Endpoint/Bucket/name and signed with
+// AWS Signature Version 4. There is no AWS SDK in vendor, and we only need to put,
+// get, list and delete objects.
+type s3ImageStore struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	Client *http.Client
+}
+
+const s3Timeout = 10 * time.Second
+
+func (s *s3ImageStore) do(ctx context.Context, method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	path := "/" + s.Bucket
+	if name != "" {
+		path += "/" + name
+	}
+	u, err := url.Parse(strings.TrimRight(s.Endpoint, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signV4(req, body, s.Region, s.AccessKey, s.SecretKey, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: s3Timeout}
+	}
+	return client.Do(req)
+}
+
+func s3Error(res *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3: %s %s: %s: %s", res.Request.Method, res.Request.URL.Path, res.Status, b)
+}
+
+func (s *s3ImageStore) Get(ctx context.Context, name string) ([]byte, error) {
+	if !validImageName.MatchString(name) {
+		return nil, errImageNotFound
+	}
+	res, err := s.do(ctx, "GET", name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(res.Body)
+	case http.StatusNotFound:
+		return nil, errImageNotFound
+	}
+	return nil, s3Error(res)
+}
+
+func (s *s3ImageStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	if !validImageName.MatchString(name) {
+		return time.Time{}, errImageNotFound
+	}
+	res, err := s.do(ctx, "HEAD", name, nil, nil, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return http.ParseTime(res.Header.Get("Last-Modified"))
+	case http.StatusNotFound:
+		return time.Time{}, errImageNotFound
+	}
+	return time.Time{}, s3Error(res)
+}
+
+func (s *s3ImageStore) Put(ctx context.Context, name string, data []byte) error {
+	if !validImageName.MatchString(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	header := http.Header{"Content-Type": {imageMimeType(name)}}
+	res, err := s.do(ctx, "PUT", name, nil, header, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+// s3DeleteRequest is the body of DeleteObjects.
+type s3DeleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool
+	Objects []s3Object `xml:"Object"`
+}
+
+type s3Object struct {
+	Key string
+}
+
+// s3DeleteResult is the response of DeleteObjects. In quiet mode, it only lists
+// the keys that could not be deleted.
+type s3DeleteResult struct {
+	Errors []struct {
+		Key     string
+		Code    string
+		Message string
+	} `xml:"Error"`
+}
+
+// Delete deletes the objects with DeleteObjects, imageDeleteBatch keys at a time.
+func (s *s3ImageStore) Delete(ctx context.Context, names ...string) error {
+	req := s3DeleteRequest{Quiet: true}
+	for _, name := range names {
+		if validImageName.MatchString(name) {
+			req.Objects = append(req.Objects, s3Object{Key: name})
+		}
+	}
+	objects := req.Objects
+	for len(objects) > 0 {
+		n := imageDeleteBatch
+		if len(objects) < n {
+			n = len(objects)
+		}
+		req.Objects = objects[:n]
+		objects = objects[n:]
+		if err := s.deleteObjects(ctx, &req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3ImageStore) deleteObjects(ctx context.Context, req *s3DeleteRequest) error {
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+	header := http.Header{
+		"Content-Type": {"application/xml"},
+		"Content-Md5":  {base64.StdEncoding.EncodeToString(sum[:])},
+	}
+	res, err := s.do(ctx, "POST", "", url.Values{"delete": {""}}, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	var result s3DeleteResult
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		e := result.Errors[0]
+		return fmt.Errorf("s3: cannot delete %d objects, first %s: %s: %s", len(result.Errors), e.Key, e.Code, e.Message)
+	}
+	return nil
+}
+
+// s3ListResult is the response of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3ImageStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}}
+	for {
+		res, err := s.do(ctx, "GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			err := s3Error(res)
+			res.Body.Close()
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			names = append(names, c.Key)
+		}
+		if !result.IsTruncated {
+			return names, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// signV4 signs the request for the s3 service with the host and every header already
+// set, as described in "Authenticating Requests: Using the Authorization Header".
+func signV4(req *http.Request, body []byte, region, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		",SignedHeaders="+signedHeaders+",Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
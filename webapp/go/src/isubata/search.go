@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	searchPageSize  = 20
+	searchBatchSize = 200
+)
+
+// normalizeText folds the differences that should not matter when searching:
+// letter case and full-width / half-width forms of ASCII characters and spaces.
+func normalizeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '　':
+			return ' '
+		case '！' <= r && r <= '～':
+			r -= 0xfee0
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// ngrams returns the distinct unigrams and bigrams of normalized text.
+// Japanese text has no spaces between words, so every pair of adjacent characters
+// is indexed; grams never span whitespace.
+func ngrams(s string) []string {
+	seen := map[string]bool{}
+	grams := []string{}
+	for _, word := range strings.Fields(s) {
+		rs := []rune(word)
+		for i := range rs {
+			for n := 1; n <= 2 && i+n <= len(rs); n++ {
+				g := string(rs[i : i+n])
+				if !seen[g] {
+					seen[g] = true
+					grams = append(grams, g)
+				}
+			}
+		}
+	}
+	return grams
+}
+
+// termGrams returns the grams every message containing the normalized term has.
+func termGrams(term string) []string {
+	rs := []rune(term)
+	if len(rs) == 1 {
+		return []string{term}
+	}
+	grams := make([]string, 0, len(rs)-1)
+	for i := 0; i+2 <= len(rs); i++ {
+		grams = append(grams, string(rs[i:i+2]))
+	}
+	return grams
+}
+
+// SearchIndex is an in-process inverted index from n-grams to message IDs.
+// It only narrows down candidates: results are always checked against the
+// current content in the database, so stale entries left by edits and
+// deletions are harmless.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	postings map[string][]int64
+	maxID    int64
+	// pending has the messages added while a rebuild loads, to add them again
+	// to the new postings. It is nil when not rebuilding.
+	pending []indexEntry
+
+	rebuildMu sync.Mutex
+}
+
+type indexEntry struct {
+	ID      int64  `db:"id"`
+	Content string `db:"content"`
+}
+
+var searchIndex = &SearchIndex{postings: map[string][]int64{}}
+
+// insertID inserts id into the ascending list ids.
+func insertID(ids []int64, id int64) []int64 {
+	n := len(ids)
+	if n == 0 || ids[n-1] < id {
+		return append(ids, id)
+	}
+	i := sort.Search(n, func(i int) bool { return ids[i] >= id })
+	if ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+func (ix *SearchIndex) addLocked(postings map[string][]int64, id int64, content string) {
+	for _, g := range ngrams(normalizeText(content)) {
+		postings[g] = insertID(postings[g], id)
+	}
+	if ix.maxID < id {
+		ix.maxID = id
+	}
+}
+
+// Add indexes a new message, or the new content of an edited message.
+func (ix *SearchIndex) Add(id int64, content string) {
+	ix.mu.Lock()
+	ix.addLocked(ix.postings, id, content)
+	if ix.pending != nil {
+		ix.pending = append(ix.pending, indexEntry{id, content})
+	}
+	ix.mu.Unlock()
+}
+
+// Rebuild indexes every message in the database from scratch. Messages added
+// while it loads are added to the new index too.
+func (ix *SearchIndex) Rebuild() error {
+	ix.rebuildMu.Lock()
+	defer ix.rebuildMu.Unlock()
+
+	ix.mu.Lock()
+	ix.pending = []indexEntry{}
+	ix.mu.Unlock()
+	defer func() {
+		ix.mu.Lock()
+		ix.pending = nil
+		ix.mu.Unlock()
+	}()
+
+	rows, err := db.Queryx("SELECT id, content FROM message WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	postings := map[string][]int64{}
+	var maxID int64
+	for rows.Next() {
+		var r indexEntry
+		if err := rows.StructScan(&r); err != nil {
+			return err
+		}
+		for _, g := range ngrams(normalizeText(r.Content)) {
+			postings[g] = append(postings[g], r.ID)
+		}
+		maxID = r.ID
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.postings = postings
+	ix.maxID = maxID
+	for _, e := range ix.pending {
+		ix.addLocked(ix.postings, e.ID, e.Content)
+	}
+	return nil
+}
+
+// Candidates returns, newest first, the IDs of the messages that may contain
+// every term and are older than beforeID (if not zero).
+func (ix *SearchIndex) Candidates(terms []string, beforeID int64) []int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	lists := [][]int64{}
+	for _, t := range terms {
+		for _, g := range termGrams(t) {
+			lists = append(lists, ix.postings[g])
+		}
+	}
+	if len(lists) == 0 {
+		return nil
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	res := []int64{}
+	for _, id := range lists[0] {
+		if beforeID > 0 && id >= beforeID {
+			break
+		}
+		found := true
+		for _, l := range lists[1:] {
+			i := sort.Search(len(l), func(i int) bool { return l[i] >= id })
+			if i == len(l) || l[i] != id {
+				found = false
+				break
+			}
+		}
+		if found {
+			res = append(res, id)
+		}
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// SearchQuery holds the conditions of a search.
+// Only the channels visible to ViewerID are searched.
+type SearchQuery struct {
+	ViewerID  int64
+	Terms     []string
+	ChannelID int64
+	UserID    int64
+	From      time.Time
+	To        time.Time
+	BeforeID  int64
+}
+
+// searchMessages returns up to limit messages matching q, newest first.
+// The candidates of the index are read newest first in batches filtered by the
+// conditions of q, whose content is checked until limit messages match.
+// Batching keeps each query well below the placeholder limit of MySQL.
+func searchMessages(ctx context.Context, q SearchQuery, limit int) ([]Message, error) {
+	if q.UserID == -1 {
+		return []Message{}, nil
+	}
+	candidates := searchIndex.Candidates(q.Terms, q.BeforeID)
+
+	query := "SELECT msg.* FROM message msg JOIN channel c ON c.id = msg.channel_id" +
+		" LEFT JOIN channel_member m ON m.channel_id = c.id AND m.user_id = ?" +
+		" WHERE msg.id IN (?) AND msg.deleted_at IS NULL AND (c.is_private = 0 OR m.user_id IS NOT NULL)"
+	args := []interface{}{q.ViewerID, nil}
+	if q.ChannelID != 0 {
+		query += " AND msg.channel_id = ?"
+		args = append(args, q.ChannelID)
+	}
+	if q.UserID != 0 {
+		query += " AND msg.user_id = ?"
+		args = append(args, q.UserID)
+	}
+	if !q.From.IsZero() {
+		query += " AND msg.created_at >= ?"
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		query += " AND msg.created_at < ?"
+		args = append(args, q.To)
+	}
+	query += " ORDER BY msg.id DESC"
+
+	res := []Message{}
+	for len(candidates) > 0 && len(res) < limit {
+		n := searchBatchSize
+		if len(candidates) < n {
+			n = len(candidates)
+		}
+		args[1] = candidates[:n]
+		candidates = candidates[n:]
+
+		batchQuery, batchArgs, err := sqlx.In(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		messages := []Message{}
+		if err := db.SelectContext(ctx, &messages, batchQuery, batchArgs...); err != nil {
+			return nil, err
+		}
+
+	next:
+		for _, m := range messages {
+			content := normalizeText(m.Content)
+			for _, t := range q.Terms {
+				if !strings.Contains(content, t) {
+					continue next
+				}
+			}
+			res = append(res, m)
+			if len(res) == limit {
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// parseSearchQuery reads q, channel_id, user, from, to (YYYY-MM-DD, both inclusive)
+// and before_id from the request of the user viewerID.
+func parseSearchQuery(c echo.Context, viewerID int64) (SearchQuery, error) {
+	q := SearchQuery{ViewerID: viewerID, Terms: strings.Fields(normalizeText(c.QueryParam("q")))}
+
+	if s := c.QueryParam("channel_id"); s != "" && s != "0" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return q, ErrBadReqeust
+		}
+		q.ChannelID = id
+	}
+	if s := c.QueryParam("user"); s != "" {
+		u, err := getUserByName(c.Request().Context(), s)
+		if err != nil {
+			return q, err
+		}
+		if u == nil {
+			// nobody can match
+			q.UserID = -1
+		} else {
+			q.UserID = u.ID
+		}
+	}
+	if s := c.QueryParam("from"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return q, ErrBadReqeust
+		}
+		q.From = t
+	}
+	if s := c.QueryParam("to"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return q, ErrBadReqeust
+		}
+		q.To = t.AddDate(0, 0, 1)
+	}
+	if s := c.QueryParam("before_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return q, ErrBadReqeust
+		}
+		q.BeforeID = id
+	}
+	return q, nil
+}
+
+// runSearch returns the matching messages as JSON objects with their channel,
+// and the before_id of the next page (0 on the last page).
+func runSearch(ctx context.Context, q SearchQuery) ([]map[string]interface{}, int64, error) {
+	if len(q.Terms) == 0 {
+		return []map[string]interface{}{}, 0, nil
+	}
+	messages, err := searchMessages(ctx, q, searchPageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	channels, err := queryChannelInfos(ctx, q.ViewerID)
+	if err != nil {
+		return nil, 0, err
+	}
+	directs, err := queryDirectChannels(ctx, q.ViewerID)
+	if err != nil {
+		return nil, 0, err
+	}
+	names := map[int64]string{}
+	for _, ch := range channels {
+		names[ch.ID] = ch.Name
+	}
+	for _, ch := range directs {
+		names[ch.ID] = ch.Partners
+	}
+
+	res, err := jsonifyMessages(ctx, messages)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, m := range messages {
+		res[i]["channel_id"] = m.ChannelID
+		res[i]["channel_name"] = names[m.ChannelID]
+	}
+
+	var nextID int64
+	if len(messages) == searchPageSize {
+		nextID = messages[len(messages)-1].ID
+	}
+	return res, nextID, nil
+}
+
+func wantsJSON(c echo.Context) bool {
+	return c.QueryParam("format") == "json" ||
+		strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON)
+}
+
+// getSearch renders the search page, or returns the results as JSON when asked
+// with format=json or an Accept: application/json header.
+func getSearch(c echo.Context) error {
+	if wantsJSON(c) {
+		userID := sessUserID(c)
+		if userID == 0 {
+			return c.NoContent(http.StatusForbidden)
+		}
+		q, err := parseSearchQuery(c, userID)
+		if err != nil {
+			return err
+		}
+		messages, nextID, err := runSearch(c.Request().Context(), q)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"messages":       messages,
+			"next_before_id": nextID,
+		})
+	}
+
+	user, err := ensureLogin(c)
+	if user == nil {
+		return err
+	}
+	q, err := parseSearchQuery(c, user.ID)
+	if err != nil {
+		return err
+	}
+	messages, nextID, err := runSearch(c.Request().Context(), q)
+	if err != nil {
+		return err
+	}
+	channels, err := queryChannelInfos(c.Request().Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	directs, err := queryDirectChannels(c.Request().Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	next := c.QueryParams()
+	next.Set("before_id", strconv.FormatInt(nextID, 10))
+
+	return c.Render(http.StatusOK, "search", map[string]interface{}{
+		"ChannelID":     0,
+		"Channels":      channels,
+		"Directs":       directs,
+		"User":          user,
+		"Query":         c.QueryParam("q"),
+		"FilterChannel": q.ChannelID,
+		"FilterUser":    c.QueryParam("user"),
+		"From":          c.QueryParam("from"),
+		"To":            c.QueryParam("to"),
+		"Messages":      messages,
+		"NextURL":       template.URL("/search?" + next.Encode()),
+		"NextPage":      nextID != 0,
+	})
+}
+
+func rebuildSearchIndex() {
+	start := time.Now()
+	if err := searchIndex.Rebuild(); err != nil {
+		log.Println("failed to build the search index:", err)
+		return
+	}
+	log.Printf("Built the search index in %v.", time.Since(start))
+}
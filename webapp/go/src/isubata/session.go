@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+// Sessions are kept on the server so that they can be listed and revoked.
+// The cookie only carries the session ID, signed with the session secrets.
+//
+// The session-secrets setting is a list of secrets. The first one signs
+// new cookies and the others are still accepted, so that a secret can be rotated
+// without logging everybody out.
+// The session-store setting selects where sessions are kept: "mysql" (default) or "memory".
+
+const (
+	sessionMaxAge        = 360000
+	sessionTouchInterval = time.Minute
+	sessionGCInterval    = time.Hour
+)
+
+// SessionRecord is a login session.
+type SessionRecord struct {
+	ID         string    `db:"id"`
+	UserID     int64     `db:"user_id"`
+	UserAgent  string    `db:"user_agent"`
+	IPAddress  string    `db:"ip_address"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+// Handle identifies the session in lists without revealing its ID.
+func (r *SessionRecord) Handle() string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(r.ID)))[:16]
+}
+
+// SessionBackend stores session records.
+type SessionBackend interface {
+	// Get returns nil if the session does not exist or has expired.
+	Get(id string) (*SessionRecord, error)
+	// Put creates the session, or updates its user and expiry.
+	Put(rec *SessionRecord) error
+	Touch(id string, t time.Time) error
+	Delete(id string) error
+	// ListByUser returns the sessions of the user, most recently used first.
+	ListByUser(userID int64) ([]SessionRecord, error)
+	DeleteByUser(userID int64) error
+	DeleteExpired() error
+	DeleteAll() error
+	// Count returns the number of sessions that have not expired.
+	Count() (int, error)
+}
+
+type memorySessionBackend struct {
+	mu       sync.RWMutex
+	sessions map[string]SessionRecord
+}
+
+func newMemorySessionBackend() *memorySessionBackend {
+	return &memorySessionBackend{sessions: map[string]SessionRecord{}}
+}
+
+func (b *memorySessionBackend) Get(id string) (*SessionRecord, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	rec, ok := b.sessions[id]
+	if !ok || !rec.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+func (b *memorySessionBackend) Put(rec *SessionRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := *rec
+	if old, ok := b.sessions[rec.ID]; ok {
+		r.CreatedAt = old.CreatedAt
+	}
+	b.sessions[rec.ID] = r
+	return nil
+}
+
+func (b *memorySessionBackend) Touch(id string, t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rec, ok := b.sessions[id]; ok {
+		rec.LastSeenAt = t
+		b.sessions[id] = rec
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) Delete(id string) error {
+	b.mu.Lock()
+	delete(b.sessions, id)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memorySessionBackend) ListByUser(userID int64) ([]SessionRecord, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	now := time.Now()
+	res := []SessionRecord{}
+	for _, rec := range b.sessions {
+		if rec.UserID == userID && rec.ExpiresAt.After(now) {
+			res = append(res, rec)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].LastSeenAt.After(res[j].LastSeenAt) })
+	return res, nil
+}
+
+func (b *memorySessionBackend) DeleteByUser(userID int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, rec := range b.sessions {
+		if rec.UserID == userID {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) DeleteExpired() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for id, rec := range b.sessions {
+		if !rec.ExpiresAt.After(now) {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) DeleteAll() error {
+	b.mu.Lock()
+	b.sessions = map[string]SessionRecord{}
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memorySessionBackend) Count() (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	now := time.Now()
+	n := 0
+	for _, rec := range b.sessions {
+		if rec.ExpiresAt.After(now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+type mysqlSessionBackend struct{}
+
+func (mysqlSessionBackend) Get(id string) (*SessionRecord, error) {
+	rec := SessionRecord{}
+	err := db.Get(&rec, "SELECT * FROM session WHERE id = ? AND expires_at > NOW()", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (mysqlSessionBackend) Put(rec *SessionRecord) error {
+	_, err := db.Exec(
+		"INSERT INTO session (id, user_id, user_agent, ip_address, created_at, last_seen_at, expires_at)"+
+			" VALUES (?, ?, ?, ?, ?, ?, ?)"+
+			" ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), last_seen_at = VALUES(last_seen_at),"+
+			" expires_at = VALUES(expires_at)",
+		rec.ID, rec.UserID, rec.UserAgent, rec.IPAddress, rec.CreatedAt, rec.LastSeenAt, rec.ExpiresAt)
+	return err
+}
+
+func (mysqlSessionBackend) Touch(id string, t time.Time) error {
+	_, err := db.Exec("UPDATE session SET last_seen_at = ? WHERE id = ?", t, id)
+	return err
+}
+
+func (mysqlSessionBackend) Delete(id string) error {
+	_, err := db.Exec("DELETE FROM session WHERE id = ?", id)
+	return err
+}
+
+func (mysqlSessionBackend) ListByUser(userID int64) ([]SessionRecord, error) {
+	res := []SessionRecord{}
+	err := db.Select(&res,
+		"SELECT * FROM session WHERE user_id = ? AND expires_at > NOW() ORDER BY last_seen_at DESC",
+		userID)
+	return res, err
+}
+
+func (mysqlSessionBackend) DeleteByUser(userID int64) error {
+	_, err := db.Exec("DELETE FROM session WHERE user_id = ?", userID)
+	return err
+}
+
+func (mysqlSessionBackend) DeleteExpired() error {
+	_, err := db.Exec("DELETE FROM session WHERE expires_at <= NOW()")
+	return err
+}
+
+func (mysqlSessionBackend) DeleteAll() error {
+	_, err := db.Exec("DELETE FROM session")
+	return err
+}
+
+func (mysqlSessionBackend) Count() (int, error) {
+	var n int
+	err := db.Get(&n, "SELECT COUNT(*) FROM session WHERE expires_at > NOW()")
+	return n, err
+}
+
+// ServerStore is a sessions.Store keeping the sessions in a SessionBackend.
+// Only "user_id" is stored: a session without it is deleted when saved.
+type ServerStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	Backend SessionBackend
+}
+
+// NewServerStore returns a store signing cookies with the secrets, the first one
+// being used for new cookies.
+func NewServerStore(backend SessionBackend, secrets ...[]byte) *ServerStore {
+	pairs := make([][]byte, 0, len(secrets)*2)
+	for _, s := range secrets {
+		pairs = append(pairs, s, nil)
+	}
+	return &ServerStore{
+		Codecs: securecookie.CodecsFromPairs(pairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   sessionMaxAge,
+			HttpOnly: true,
+		},
+		Backend: backend,
+	}
+}
+
+func (s *ServerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *ServerStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	opts := *s.Options
+	sess.Options = &opts
+	sess.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return sess, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		return sess, err
+	}
+	rec, err := s.Backend.Get(id)
+	if err != nil || rec == nil {
+		return sess, err
+	}
+
+	sess.ID = id
+	sess.Values["user_id"] = rec.UserID
+	sess.IsNew = false
+	if now := time.Now(); now.Sub(rec.LastSeenAt) > sessionTouchInterval {
+		if err := s.Backend.Touch(id, now); err != nil {
+			return sess, err
+		}
+	}
+	return sess, nil
+}
+
+func (s *ServerStore) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	userID, _ := sess.Values["user_id"].(int64)
+	if sess.Options.MaxAge < 0 || userID == 0 {
+		if sess.ID != "" {
+			if err := s.Backend.Delete(sess.ID); err != nil {
+				return err
+			}
+			sess.ID = ""
+		}
+		opts := *sess.Options
+		opts.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(sess.Name(), "", &opts))
+		return nil
+	}
+
+	if sess.ID == "" {
+		sess.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	maxAge := sess.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = sessionMaxAge
+	}
+	now := time.Now()
+	rec := &SessionRecord{
+		ID:         sess.ID,
+		UserID:     userID,
+		UserAgent:  r.UserAgent(),
+		IPAddress:  clientIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Duration(maxAge) * time.Second),
+	}
+	if err := s.Backend.Put(rec); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(sess.Name(), sess.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(sess.Name(), encoded, sess.Options))
+	return nil
+}
+
+var sessionStore *ServerStore
+
+func newSessionStore() *ServerStore {
+	var backend SessionBackend
+	switch cfg.SessionStore {
+	case "mysql":
+		backend = mysqlSessionBackend{}
+	case "memory":
+		backend = newMemorySessionBackend()
+	default:
+		log.Fatalf("unknown session store: %q", cfg.SessionStore)
+	}
+
+	secrets := make([][]byte, len(cfg.SessionSecrets))
+	for i, s := range cfg.SessionSecrets {
+		secrets[i] = []byte(s)
+	}
+	return NewServerStore(backend, secrets...)
+}
+
+func expireSessions() {
+	for range time.Tick(sessionGCInterval) {
+		if err := sessionStore.Backend.DeleteExpired(); err != nil {
+			log.Println("failed to delete expired sessions:", err)
+		}
+	}
+}
+
+func sessID(c echo.Context) string {
+	sess, _ := session.Get("session", c)
+	return sess.ID
+}
+
+// querySessions returns the sessions of the user for display, with "handle"
+// to revoke them and "current" set for the session of the request.
+func querySessions(userID int64, currentID string) ([]map[string]interface{}, error) {
+	recs, err := sessionStore.Backend.ListByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]map[string]interface{}, 0, len(recs))
+	for _, rec := range recs {
+		res = append(res, map[string]interface{}{
+			"handle":       rec.Handle(),
+			"user_agent":   rec.UserAgent,
+			"ip_address":   rec.IPAddress,
+			"created_at":   rec.CreatedAt.Format("2006/01/02 15:04:05"),
+			"last_seen_at": rec.LastSeenAt.Format("2006/01/02 15:04:05"),
+			"current":      rec.ID == currentID,
+		})
+	}
+	return res, nil
+}
+
+// revokeSession deletes the session of the user identified by its handle.
+func revokeSession(userID int64, handle string) error {
+	recs, err := sessionStore.Backend.ListByUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if rec.Handle() == handle {
+			return sessionStore.Backend.Delete(rec.ID)
+		}
+	}
+	return echo.ErrNotFound
+}
+
+func postRevokeSession(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	if err := revokeSession(self.ID, c.FormValue("handle")); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/profile/"+self.Name)
+}
+
+// postRevokeAllSessions logs the user out everywhere, including this browser.
+func postRevokeAllSessions(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	if err := sessionStore.Backend.DeleteByUser(self.ID); err != nil {
+		return err
+	}
+	sessClearUserID(c)
+	return c.Redirect(http.StatusSeeOther, "/login")
+}
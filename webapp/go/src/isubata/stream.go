@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	streamKeepAlive = 15 * time.Second
+)
+
+func writeEvent(w *echo.Response, event string, id int64, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+// writeMessageChange sends a "message_update" event with the edited message,
+// or a "message_delete" event with the ID of the deleted message.
+// Changes to replies are sent as a "message_update" of the top-level message
+// since they are not part of the timeline but change its reply count.
+func writeMessageChange(ctx context.Context, w *echo.Response, ev Event) error {
+	if ev.ParentID != 0 {
+		ev = Event{Type: EventEdit, ChannelID: ev.ChannelID, MessageID: ev.ParentID}
+	}
+	switch ev.Type {
+	case EventEdit, EventReaction:
+		m, err := getMessageByID(ctx, ev.MessageID)
+		if err != nil || m == nil || m.DeletedAt.Valid {
+			return nil
+		}
+		r, err := jsonifyMessage(ctx, *m)
+		if err != nil {
+			return nil
+		}
+		return writeEvent(w, "message_update", 0, r)
+	case EventDelete:
+		return writeEvent(w, "message_delete", 0, map[string]interface{}{"id": ev.MessageID})
+	}
+	return nil
+}
+
+// writeSentMessages sends the state of the latest messages of a channel up to lastID,
+// the ones the client may show, as "message_update" and "message_delete" events.
+func writeSentMessages(ctx context.Context, w *echo.Response, chanID, lastID int64) error {
+	messages := []Message{}
+	err := db.SelectContext(ctx, &messages, "SELECT * FROM message WHERE id <= ? AND channel_id = ? AND parent_id = 0 ORDER BY id DESC LIMIT 100",
+		lastID, chanID)
+	if err != nil {
+		return err
+	}
+	live := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if m.DeletedAt.Valid {
+			if err := writeEvent(w, "message_delete", 0, map[string]interface{}{"id": m.ID}); err != nil {
+				return err
+			}
+			continue
+		}
+		live = append(live, m)
+	}
+	updates, err := jsonifyMessages(ctx, live)
+	if err != nil {
+		return err
+	}
+	for _, r := range updates {
+		if err := writeEvent(w, "message_update", 0, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// channelSet is the set of channels visible to a stream's user, shared with the
+// filter of its hub subscription.
+type channelSet struct {
+	mu  sync.Mutex
+	ids map[int64]bool
+}
+
+// load reads the channels visible to the user and reports whether they changed.
+func (s *channelSet) load(ctx context.Context, userID int64) (bool, error) {
+	channels, err := queryChannels(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	ids := make(map[int64]bool, len(channels))
+	for _, chID := range channels {
+		ids[chID] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := len(ids) != len(s.ids)
+	for chID := range ids {
+		if !s.ids[chID] {
+			changed = true
+		}
+	}
+	s.ids = ids
+	return changed, nil
+}
+
+func (s *channelSet) has(chID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[chID]
+}
+
+// accepts is the hub filter: events of the visible channels, and the membership and
+// channel changes that can change them.
+func (s *channelSet) accepts(ev Event) bool {
+	return ev.Type == EventMember || ev.Type == EventChannel || s.has(ev.ChannelID)
+}
+
+// getStream pushes the messages of a channel and the unread counts of every channel
+// as Server-Sent Events.
+// "message" events carry the same objects as GET /message and "unread" events the same
+// array as GET /fetch. Edits and deletions of messages already sent are pushed as
+// "message_update" and "message_delete" events.
+func getStream(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	chanID, err := strconv.ParseInt(c.QueryParam("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	// EventSource sends back the id of the last event it received when reconnecting.
+	lastIDStr := c.Request().Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = c.QueryParam("last_message_id")
+	}
+	var lastID int64
+	if lastIDStr != "" {
+		lastID, err = strconv.ParseInt(lastIDStr, 10, 64)
+		if err != nil {
+			return ErrBadReqeust
+		}
+	}
+
+	if err := checkChannelAccess(c.Request().Context(), userID, chanID); err != nil {
+		return err
+	}
+
+	visible := &channelSet{}
+	if _, err := visible.load(c.Request().Context(), userID); err != nil {
+		return err
+	}
+	sub := hub.Subscribe(visible.accepts)
+	defer hub.Unsubscribe(sub)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ctx := c.Request().Context()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	// Only resync what the events received touch: the messages of this channel,
+	// and the unread counts if any visible channel changed.
+	// When events were dropped, resync everything instead.
+	var events []Event
+	first := true
+	overflow := false
+	for {
+		syncMessages, syncUnread := first, first
+		first = false
+		if overflow {
+			if _, err := visible.load(c.Request().Context(), userID); err != nil {
+				return err
+			}
+			syncMessages, syncUnread = true, true
+		}
+		for _, ev := range events {
+			if ev.Type == EventMember || ev.Type == EventChannel {
+				changed, err := visible.load(c.Request().Context(), userID)
+				if err != nil {
+					return err
+				}
+				syncUnread = syncUnread || changed
+				break
+			}
+		}
+		for _, ev := range events {
+			syncMessages = syncMessages || ev.ChannelID == chanID
+			syncUnread = syncUnread || visible.has(ev.ChannelID)
+		}
+
+		// Messages already sent may have been edited or deleted since.
+		if overflow && lastID > 0 {
+			if err := checkChannelAccess(c.Request().Context(), userID, chanID); err != nil {
+				return nil
+			}
+			if err := writeSentMessages(c.Request().Context(), w, chanID, lastID); err != nil {
+				return nil
+			}
+		} else {
+			for _, ev := range events {
+				target := ev.MessageID
+				if ev.ParentID != 0 {
+					target = ev.ParentID
+				}
+				if ev.ChannelID != chanID || target > lastID {
+					continue
+				}
+				if err := writeMessageChange(c.Request().Context(), w, ev); err != nil {
+					return nil
+				}
+			}
+		}
+		events = events[:0]
+
+		if syncMessages {
+			// The user may have left or been removed from a private channel.
+			if err := checkChannelAccess(c.Request().Context(), userID, chanID); err != nil {
+				return nil
+			}
+
+			messages, err := readMessages(c.Request().Context(), userID, chanID, lastID)
+			if err != nil {
+				return err
+			}
+			for _, m := range messages {
+				id := m["id"].(int64)
+				if err := writeEvent(w, "message", id, m); err != nil {
+					return nil
+				}
+				lastID = id
+			}
+		}
+
+		if syncUnread {
+			unread, err := unreadCounts(c.Request().Context(), userID)
+			if err != nil {
+				return err
+			}
+			if err := writeEvent(w, "unread", 0, unread); err != nil {
+				return nil
+			}
+		}
+		w.Flush()
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-hub.Done():
+				return nil
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return nil
+				}
+				w.Flush()
+			case ev := <-sub.C:
+				// Coalesce a burst of events into a single resync.
+				events = append(events, ev)
+				for len(sub.C) > 0 {
+					events = append(events, <-sub.C)
+				}
+				overflow = sub.Overflowed()
+				break wait
+			}
+		}
+	}
+}
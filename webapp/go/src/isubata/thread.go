@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	threadPageSize = 100
+)
+
+// addReply posts a reply to the top-level message parentID in the channel chanID.
+func addReply(ctx context.Context, parentID, chanID, userID int64, content string) (int64, error) {
+	parent, err := getMessageByID(ctx, parentID)
+	if err != nil {
+		return 0, err
+	}
+	if parent == nil || parent.DeletedAt.Valid || parent.ParentID != 0 || parent.ChannelID != chanID {
+		return 0, ErrBadReqeust
+	}
+	if err := checkChannelWritable(ctx, chanID); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Counting first locks the parent, so that replies get their IDs in the order
+	// they are counted.
+	_, err = tx.ExecContext(ctx, "UPDATE message SET reply_count = reply_count + 1, last_reply_at = NOW() WHERE id = ?",
+		parentID)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO message (channel_id, user_id, content, created_at, parent_id) VALUES (?, ?, ?, NOW(), ?)",
+		chanID, userID, content, parentID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	if err := tx.GetContext(ctx, &count, "SELECT reply_count FROM message WHERE id = ?", parentID); err != nil {
+		return 0, err
+	}
+	// Replying to a thread follows it, and the author of the message follows its thread.
+	if err := markThreadRead(ctx, tx, userID, chanID, parentID, id, count); err != nil {
+		return 0, err
+	}
+	if parent.UserID != userID {
+		_, err = tx.ExecContext(ctx, "INSERT IGNORE INTO thread_haveread (user_id, parent_id, message_id, reply_count, updated_at, created_at)"+
+			" VALUES (?, ?, 0, 0, NOW(), NOW())", parent.UserID, parentID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := addMentions(ctx, tx, id, chanID, parentID, userID, content); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	searchIndex.Add(id, content)
+
+	messagesPosted.Inc("reply")
+	hub.Publish(Event{Type: EventReply, ChannelID: chanID, MessageID: id, ParentID: parentID})
+	return id, nil
+}
+
+// markThreadRead records that the user has read the thread up to the reply msgID,
+// the count-th visible reply, and the mentions in it. thread_haveread works like
+// haveread: the number of unread replies is the reply_count of the parent minus
+// the count read.
+func markThreadRead(ctx context.Context, tx *sqlx.Tx, userID, chanID, parentID, msgID, count int64) error {
+	if err := readMentions(ctx, tx, userID, chanID, parentID, msgID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO thread_haveread (user_id, parent_id, message_id, reply_count, updated_at, created_at)"+
+		" VALUES (?, ?, ?, ?, NOW(), NOW())"+
+		" ON DUPLICATE KEY UPDATE reply_count = IF(VALUES(message_id) >= IFNULL(message_id, 0), VALUES(reply_count), reply_count),"+
+		" message_id = GREATEST(IFNULL(message_id, 0), VALUES(message_id)), updated_at = NOW()",
+		userID, parentID, msgID, count)
+	return err
+}
+
+// queryThreadUnread returns, per channel, the number of replies the user has not read
+// in the threads they follow: threads they opened or replied to, and threads started
+// by their own messages.
+func queryThreadUnread(ctx context.Context, userID int64) (map[int64]int64, error) {
+	type row struct {
+		ChannelID int64 `db:"channel_id"`
+		Cnt       int64 `db:"cnt"`
+	}
+	rows := []row{}
+	err := db.SelectContext(ctx, &rows,
+		"SELECT p.channel_id, SUM(p.reply_count - t.reply_count) AS cnt FROM thread_haveread t"+
+			" JOIN message p ON p.id = t.parent_id"+
+			" WHERE t.user_id = ? AND p.deleted_at IS NULL AND p.reply_count > t.reply_count"+
+			" GROUP BY p.channel_id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int64]int64, len(rows))
+	for _, r := range rows {
+		res[r.ChannelID] = r.Cnt
+	}
+	return res, nil
+}
+
+// readReplies returns up to threadPageSize replies newer than lastID, oldest first,
+// and marks them as read by the user.
+func readReplies(ctx context.Context, userID, parentID, lastID int64) ([]map[string]interface{}, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// As in readMessages, the shared lock keeps replies from being counted while
+	// the read position is computed.
+	var parent struct {
+		ChannelID  int64 `db:"channel_id"`
+		ReplyCount int64 `db:"reply_count"`
+	}
+	err = tx.GetContext(ctx, &parent, "SELECT channel_id, reply_count FROM message WHERE id = ? LOCK IN SHARE MODE", parentID)
+	if err != nil {
+		return nil, err
+	}
+	count := parent.ReplyCount
+	replies := []Message{}
+	err = tx.SelectContext(ctx, &replies,
+		"SELECT * FROM message WHERE parent_id = ? AND id > ? ORDER BY id LIMIT ?",
+		parentID, lastID, threadPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	lastReadID := lastID
+	if len(replies) > 0 {
+		lastReadID = replies[len(replies)-1].ID
+	}
+	if len(replies) == threadPageSize {
+		var after int64
+		err := tx.GetContext(ctx, &after, "SELECT COUNT(*) FROM message WHERE parent_id = ? AND id > ? AND deleted_at IS NULL",
+			parentID, lastReadID)
+		if err != nil {
+			return nil, err
+		}
+		count -= after
+	}
+	if err := markThreadRead(ctx, tx, userID, parent.ChannelID, parentID, lastReadID, count); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	visible := make([]Message, 0, len(replies))
+	for _, m := range replies {
+		if !m.DeletedAt.Valid {
+			visible = append(visible, m)
+		}
+	}
+	response, err := jsonifyMessages(ctx, visible)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// getThread returns a top-level message and its replies newer than last_reply_id.
+// Pass the ID of the last reply received as last_reply_id to get the next page.
+func getThread(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	msgID, err := messageIDParam(c)
+	if err != nil {
+		return err
+	}
+	var lastID int64
+	if s := c.QueryParam("last_reply_id"); s != "" {
+		lastID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return ErrBadReqeust
+		}
+	}
+
+	parent, err := getMessageByID(c.Request().Context(), msgID)
+	if err != nil {
+		return err
+	}
+	if parent == nil || parent.DeletedAt.Valid || parent.ParentID != 0 {
+		return echo.ErrNotFound
+	}
+	if err := checkChannelAccess(c.Request().Context(), userID, parent.ChannelID); err != nil {
+		return err
+	}
+	p, err := jsonifyMessage(c.Request().Context(), *parent)
+	if err != nil {
+		return err
+	}
+
+	replies, err := readReplies(c.Request().Context(), userID, parent.ID, lastID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"parent":  p,
+		"replies": replies,
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Unread counts are kept as counters instead of counting messages on every poll:
+// channel_counter has the number of visible top-level messages of each channel,
+// updated in the transactions posting and deleting them, and haveread has that
+// number as of the last message read. The unread count is the difference.
+//
+// Deleting a message decrements both the channel counter and the read positions
+// past it. Readers take a shared lock on the counter, so that they do not record a
+// count a concurrent post or delete has already changed; posting locks it before
+// inserting the message, so that IDs are given in the order messages are counted.
+//
+// Replies are counted the same way with the reply_count of their parent and
+// thread_haveread (see markThreadRead), summed over the threads the user follows.
+// Mentions carry their own is_unread flag, cleared when they are read or deleted
+// (see addMentions). None of the counts reads the messages themselves.
+
+// incrMessageCount adds delta to the number of messages of the channel.
+func incrMessageCount(ctx context.Context, tx *sqlx.Tx, chanID, delta int64) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO channel_counter (channel_id, message_count) VALUES (?, ?)"+
+		" ON DUPLICATE KEY UPDATE message_count = message_count + ?",
+		chanID, delta, delta)
+	return err
+}
+
+// uncountMessage removes the deleted top-level message from the counters.
+func uncountMessage(ctx context.Context, tx *sqlx.Tx, m *Message) error {
+	if err := incrMessageCount(ctx, tx, m.ChannelID, -1); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE haveread SET message_count = message_count - 1"+
+		" WHERE channel_id = ? AND message_id >= ?", m.ChannelID, m.ID)
+	return err
+}
+
+// resetMessageCounts recounts the messages of every channel, after /initialize.
+func resetMessageCounts(ctx context.Context) {
+	db.MustExecContext(ctx, "DELETE FROM channel_counter")
+	db.MustExecContext(ctx, "INSERT INTO channel_counter (channel_id, message_count)"+
+		" SELECT channel_id, COUNT(*) FROM message WHERE parent_id = 0 AND deleted_at IS NULL"+
+		" GROUP BY channel_id")
+}
+
+// readMessages returns the messages newer than lastID in the channel, oldest first,
+// and marks them as read by the user.
+func readMessages(ctx context.Context, userID, chanID, lastID int64) ([]map[string]interface{}, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var count int64
+	err = tx.GetContext(ctx, &count, "SELECT message_count FROM channel_counter WHERE channel_id = ? LOCK IN SHARE MODE", chanID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	messages := []Message{}
+	err = tx.SelectContext(ctx, &messages, "SELECT * FROM message WHERE id > ? AND channel_id = ? AND parent_id = 0 ORDER BY id DESC LIMIT 100",
+		lastID, chanID)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > 0 {
+		// messages[0] is the latest message, so everything counted is read.
+		_, err := tx.ExecContext(ctx, "INSERT INTO haveread (user_id, channel_id, message_id, message_count, updated_at, created_at)"+
+			" VALUES (?, ?, ?, ?, NOW(), NOW())"+
+			" ON DUPLICATE KEY UPDATE message_id = VALUES(message_id), message_count = VALUES(message_count), updated_at = NOW()",
+			userID, chanID, messages[0].ID, count)
+		if err != nil {
+			return nil, err
+		}
+		if err := readMentions(ctx, tx, userID, chanID, 0, messages[0].ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	visible := make([]Message, 0, len(messages))
+	for i := len(messages) - 1; i >= 0; i-- {
+		if !messages[i].DeletedAt.Valid {
+			visible = append(visible, messages[i])
+		}
+	}
+	return jsonifyMessages(ctx, visible)
+}
+
+// unreadCounts returns, for every channel visible to the user, the number of unread
+// messages, of unread replies in the threads they follow and of unread mentions.
+func unreadCounts(ctx context.Context, userID int64) ([]map[string]interface{}, error) {
+	type row struct {
+		ChannelID int64 `db:"channel_id"`
+		Unread    int64 `db:"unread"`
+	}
+	rows := []row{}
+	err := db.SelectContext(ctx, &rows,
+		"SELECT c.id AS channel_id, COALESCE(cc.message_count, 0) - COALESCE(h.message_count, 0) AS unread"+
+			" FROM channel c"+
+			" LEFT JOIN channel_member m ON m.channel_id = c.id AND m.user_id = ?"+
+			" LEFT JOIN channel_counter cc ON cc.channel_id = c.id"+
+			" LEFT JOIN haveread h ON h.channel_id = c.id AND h.user_id = ?"+
+			" WHERE c.is_private = 0 OR m.user_id IS NOT NULL",
+		userID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	threadUnread, err := queryThreadUnread(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	mentions, err := queryUnreadMentions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := []map[string]interface{}{}
+	for _, r := range rows {
+		if r.Unread < 0 {
+			r.Unread = 0
+		}
+		resp = append(resp, map[string]interface{}{
+			"channel_id":    r.ChannelID,
+			"unread":        r.Unread,
+			"thread_unread": threadUnread[r.ChannelID],
+			"mentions":      mentions[r.ChannelID]})
+	}
+	return resp, nil
+}
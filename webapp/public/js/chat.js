@@ -1,18 +1,43 @@
 var last_message_id = 0
 
+// State-changing requests must carry the CSRF token of the page.
+$.ajaxSetup({
+    headers: { "X-CSRF-Token": $('meta[name="csrf-token"]').attr("content") }
+})
+
+function message_date(msg) {
+    var date = msg["date"]
+    if (msg["edited_at"]) {
+        date += " (編集済み)"
+    }
+    return date
+}
+
 function append(msg) {
     var text = msg["content"]
     var name = msg["user"]["display_name"] + "@" + msg["user"]["name"]
-    var date = msg["date"]
     var icon = msg["user"]["avatar_icon"]
-    var p = $('<div class="media message"></div>')
+    var p = $('<div class="media message"></div>').attr('id', 'message-' + msg['id'])
 		var body = $('<div class="media-body">')
     $('<img class="avatar d-flex align-self-start mr-3" alt="no avatar">').attr('src', '/icons/'+icon).appendTo(p)
     $('<h5 class="mt-0"></h5>').append($('<a></a>').attr('href', '/profile/'+msg["user"]["name"]).text(name)).appendTo(body)
     $('<p class="content"></p>').text(text).appendTo(body)
-    $('<p class="message-date"></p>').text(date).appendTo(body)
+    $('<p class="message-date"></p>').text(message_date(msg)).appendTo(body)
+    $('<p class="message-reactions"></p>').appendTo(body)
+    $('<p class="message-replies"></p>').append(
+        $('<a href="#"></a>').text(replies_label(msg)).click(function(e) { e.preventDefault(); toggle_thread(msg['id']) })
+    ).appendTo(body)
+    $('<div class="thread"></div>').hide().appendTo(body)
+    if (msg["user"]["name"] == $("#timeline").data("user-name")) {
+        var actions = $('<p class="message-actions"></p>')
+        $('<a href="#">編集</a>').click(function(e) { e.preventDefault(); on_edit_button(msg['id']) }).appendTo(actions)
+        actions.append(" ")
+        $('<a href="#">削除</a>').click(function(e) { e.preventDefault(); on_delete_button(msg['id']) }).appendTo(actions)
+        actions.appendTo(body)
+    }
     body.appendTo(p)
     p.appendTo("#timeline")
+    render_reactions(msg['id'], msg["reactions"])
     last_message_id = Math.max(last_message_id, msg['id'])
     var messages = $("div[class*='media message']")
     if (100 < messages.length) {
@@ -35,17 +60,32 @@ function get_channel_id() {
     return "1"
 }
 
-function fetch_unread(callback) {
+var fetch_version = 0
+
+function fetch_unread(callback, failure) {
     $.ajax({
         dataType: "json",
         async: true,
         type: "GET",
         url: "/fetch",
-        success: callback
+        data: {
+            since: fetch_version
+        },
+        success: function(json, status, xhr) {
+            if (xhr.status == 204) {
+                // nothing changed before the server timed out
+                callback([])
+                return
+            }
+            fetch_version = json.version
+            callback(json.unread)
+        },
+        error: failure
     })
 }
 
-function get_message(callback) {
+// complete(xhr, status) is called when the request ends, successful or not.
+function get_message(callback, complete) {
     channel_id = get_channel_id()
     msg_id = last_message_id
 
@@ -68,6 +108,7 @@ function get_message(callback) {
             last_message_id: last_message_id,
             channel_id: channel_id
         },
+        complete: complete,
         success: function(messages) {
             callback(messages)
         }
@@ -92,6 +133,183 @@ function post_message(msg) {
     })
 }
 
+var last_reaction_id = null
+
+function render_reactions(id, reactions) {
+    var box = $("#message-" + id).find(".message-reactions").first()
+    var me = $("#timeline").data("user-name")
+    box.empty()
+    ;(reactions || []).forEach(function(reaction) {
+        var mine = reaction.users.indexOf(me) >= 0
+        $('<a href="#" class="badge"></a>')
+            .addClass(mine ? "badge-primary" : "badge-default")
+            .attr("title", reaction.users.join(", "))
+            .text(reaction.emoji + " " + reaction.count)
+            .click(function(e) { e.preventDefault(); toggle_reaction(id, reaction.emoji, mine) })
+            .appendTo(box)
+        box.append(" ")
+    })
+    $('<a href="#" class="badge badge-default">+</a>').click(function(e) {
+        e.preventDefault()
+        var emoji = window.prompt("リアクション")
+        if (emoji) {
+            toggle_reaction(id, emoji, false)
+        }
+    }).appendTo(box)
+}
+
+function toggle_reaction(id, emoji, remove) {
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: remove ? "DELETE" : "POST",
+        url: "/message/" + id + "/reactions" + (remove ? "?emoji=" + encodeURIComponent(emoji) : ""),
+        data: remove ? null : { emoji: emoji },
+        success: function(json) {
+            render_reactions(json.id, json.reactions)
+        }
+    })
+}
+
+function fetch_reactions() {
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: "GET",
+        url: "/reactions",
+        data: last_reaction_id == null ? { channel_id: get_channel_id() } : {
+            channel_id: get_channel_id(),
+            last_reaction_id: last_reaction_id
+        },
+        success: function(json) {
+            last_reaction_id = json.last_reaction_id
+            json.messages.forEach(function(m) {
+                render_reactions(m.id, m.reactions)
+            })
+        }
+    })
+}
+
+function replies_label(msg) {
+    if (!msg["reply_count"]) {
+        return "返信する"
+    }
+    return "返信 " + msg["reply_count"] + "件 (最終返信 " + msg["last_reply_at"] + ")"
+}
+
+function update_message(msg) {
+    var p = $("#message-" + msg['id'])
+    p.find(".content").first().text(msg["content"])
+    p.find(".message-date").first().text(message_date(msg))
+    p.find(".message-replies a").text(replies_label(msg))
+    render_reactions(msg['id'], msg["reactions"])
+    var thread = p.find(".thread")
+    if (thread.is(":visible")) {
+        load_replies(msg['id'])
+    }
+}
+
+function load_replies(parent_id) {
+    var thread = $("#message-" + parent_id).find(".thread")
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: "GET",
+        url: "/thread/" + parent_id,
+        data: {
+            last_reply_id: thread.data("last-reply-id") || 0
+        },
+        success: function(json) {
+            json.replies.forEach(function(reply) {
+                var r = $('<div class="reply"></div>')
+                $('<strong></strong>').text(reply["user"]["display_name"] + "@" + reply["user"]["name"]).appendTo(r)
+                $('<span class="content"></span>').text(" " + reply["content"]).appendTo(r)
+                $('<span class="message-date"></span>').text(" " + message_date(reply)).appendTo(r)
+                r.insertBefore(thread.find(".reply-box"))
+                thread.data("last-reply-id", reply['id'])
+            })
+        }
+    })
+}
+
+function toggle_thread(parent_id) {
+    var thread = $("#message-" + parent_id).find(".thread")
+    if (thread.is(":visible")) {
+        thread.hide()
+        return
+    }
+    if (thread.children().length == 0) {
+        var box = $('<div class="reply-box input-group"></div>')
+        var input = $('<input type="text" class="form-control">')
+        input.appendTo(box)
+        $('<span class="input-group-btn"></span>').append(
+            $('<button class="btn btn-secondary">返信</button>').click(function() {
+                var msg = input.val()
+                if (msg == "") {
+                    return
+                }
+                post_reply(parent_id, msg)
+                input.val("")
+            })
+        ).appendTo(box)
+        box.appendTo(thread)
+    }
+    thread.show()
+    load_replies(parent_id)
+}
+
+function post_reply(parent_id, msg) {
+    $.ajax({
+        async: true,
+        type: "POST",
+        url: "/message",
+        data: {
+            channel_id: get_channel_id(),
+            parent_id: parent_id,
+            message: msg
+        },
+        success: function() {
+            load_replies(parent_id)
+        }
+    })
+}
+
+function remove_message(id) {
+    $("#message-" + id).remove()
+}
+
+function on_edit_button(id) {
+    var current = $("#message-" + id).find(".content").text()
+    var msg = window.prompt("メッセージを編集", current)
+    if (msg == null || msg == "" || msg == current) {
+        return
+    }
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: "PUT",
+        url: "/message/" + id,
+        data: {
+            message: msg
+        },
+        success: update_message
+    })
+}
+
+function on_delete_button(id) {
+    if (!window.confirm("メッセージを削除しますか？")) {
+        return
+    }
+    $.ajax({
+        async: true,
+        type: "DELETE",
+        url: "/message/" + id,
+        success: function() {
+            remove_message(id)
+        }
+    })
+}
+
 function on_send_button() {
     var textarea = $("#chatbox-textarea")
     var msg = textarea.val()
@@ -114,42 +332,104 @@ $(document).ready(function() {
         }
     });
 
+    if (window.EventSource) {
+        start_stream()
+    } else {
+        start_polling()
+    }
+})
+
+function update_unread(json, channel_id) {
+    json.forEach(function(channel) {
+        current_channel = channel.channel_id == channel_id
+        var badge = $("#unread-" + channel.channel_id)
+        var text = ""
+        if (!current_channel && 0 < channel.unread) {
+          text = channel.unread.toString()
+        }
+        if (!current_channel && 0 < channel.mentions) {
+          text = "@" + channel.mentions.toString() + " " + text
+        }
+        if (0 < channel.thread_unread) {
+          // unread replies in the threads the user follows
+          text += " +" + channel.thread_unread.toString()
+        }
+        badge.text(text)
+    })
+}
+
+function start_stream() {
+    channel_id = get_channel_id()
+    var source = new EventSource("/stream?channel_id=" + channel_id + "&last_message_id=" + last_message_id)
+    source.addEventListener("message", function(e) {
+        var msg = JSON.parse(e.data)
+        if (last_message_id < msg.id) {
+            append(msg)
+            go_bottom()
+        }
+    })
+    source.addEventListener("message_update", function(e) {
+        update_message(JSON.parse(e.data))
+    })
+    source.addEventListener("message_delete", function(e) {
+        remove_message(JSON.parse(e.data).id)
+    })
+    source.addEventListener("unread", function(e) {
+        update_unread(JSON.parse(e.data), channel_id)
+    })
+}
+
+function start_polling() {
+    fetch_reactions()
     get_message(function(messages) {
         messages.forEach(append)
 
-        var loading = false
+        // Poll again as soon as the previous poll ends. When it fails (network
+        // errors, 5xx during a deploy), wait longer after each failure.
+        var retry_delay = 0
+
+        function schedule(ok) {
+            if (ok) {
+                retry_delay = 0
+            } else {
+                retry_delay = Math.min(retry_delay ? retry_delay * 2 : 1000, 30000)
+            }
+            setTimeout(poll, retry_delay || 10)
+        }
 
-        setInterval(function() {
-            if (loading) return
-            loading = true
+        function poll() {
             fetch_unread(function(json) {
                 console.log(json)
                 channel_id = get_channel_id()
                 updated = false
                 json.forEach(function(channel) {
-                    current_channel = channel.channel_id == channel_id
-                    if (current_channel && 0 < channel.unread) {
+                    if (channel.channel_id == channel_id && 0 < channel.unread) {
                       updated = true
                     }
-                    var badge = $("#unread-" + channel.channel_id)
-                    if (current_channel || channel.unread == 0) {
-                      badge.text("")
-                    } else {
-                      badge.text(channel.unread.toString())
-                    }
                 })
+                update_unread(json, channel_id)
+                fetch_reactions()
                 if (updated) {
                   get_message(function(new_messages) {
                       if (0 < new_messages.length) {
                           new_messages.forEach(append)
                           go_bottom()
                       }
-                      loading = false
+                  }, function(xhr, status) {
+                      schedule(status == "success")
                   })
                 } else {
-                  loading = false
+                  schedule(true)
                 }
+            }, function() {
+                schedule(false)
             })
-        }, 10)
+        }
+
+        poll()
+    }, function(xhr, status) {
+        if (status != "success") {
+            setTimeout(start_polling, 1000)
+        }
     })
-})
+}